@@ -0,0 +1,221 @@
+package main
+
+import (
+	"backend/internals/mailer"
+	"backend/internals/models"
+	"backend/internals/repository"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+// the longest a name or an email address can be, the size of the columns
+const maxUserFieldLength = 255
+
+// userProblems tells what's wrong with the name and email address of user,
+// nothing when they're fine
+func userProblems(user models.User) []string {
+	var problems []string
+	if strings.TrimSpace(user.FirstName) == "" {
+		problems = append(problems, "first_name is required")
+	}
+	if strings.TrimSpace(user.LastName) == "" {
+		problems = append(problems, "last_name is required")
+	}
+	if utf8.RuneCountInString(user.FirstName) > maxUserFieldLength || utf8.RuneCountInString(user.LastName) > maxUserFieldLength {
+		problems = append(problems, fmt.Sprintf("names can be at most %d characters", maxUserFieldLength))
+	}
+	// a bare address, "Name <a@b.c>" isn't one
+	if addr, err := mail.ParseAddress(user.Email); err != nil || addr.Address != user.Email {
+		problems = append(problems, "email must be an email address")
+	} else if len(user.Email) > maxUserFieldLength {
+		problems = append(problems, fmt.Sprintf("email can be at most %d characters", maxUserFieldLength))
+	}
+	return problems
+}
+
+// path: GET /me
+// the account of the logged in user
+func (app *application) GetMe(w http.ResponseWriter, r *http.Request) {
+	user, err := app.requestUser(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+	_ = app.writeJSON(w, http.StatusOK, user)
+}
+
+// path: PATCH /me
+// changes the name and email address of the logged in user, the fields
+// that aren't sent stay as they are. a new address has to be verified
+// again, we mail it a link and let the old address know
+func (app *application) UpdateMe(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		FirstName *string `json:"first_name"`
+		LastName  *string `json:"last_name"`
+		Email     *string `json:"email"`
+	}
+	if err := app.readJSON(w, r, &payload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.requestUser(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+	oldEmail := user.Email
+
+	if payload.FirstName != nil {
+		user.FirstName = strings.TrimSpace(*payload.FirstName)
+	}
+	if payload.LastName != nil {
+		user.LastName = strings.TrimSpace(*payload.LastName)
+	}
+	if payload.Email != nil {
+		user.Email = strings.TrimSpace(*payload.Email)
+	}
+	if problems := userProblems(*user); len(problems) > 0 {
+		app.errorJSON(w, errors.New(strings.Join(problems, ", ")), http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := app.db(r).UpdateUserProfile(*user); err != nil {
+		if errors.Is(err, repository.ErrDuplicateEmail) {
+			app.errorJSON(w, err, http.StatusConflict)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	user, err = app.db(r).GetUserByID(user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if !strings.EqualFold(oldEmail, user.Email) {
+		slog.InfoContext(r.Context(), "email address changed", "user_id", user.ID)
+		ctx := context.WithoutCancel(r.Context())
+		app.background(func() {
+			app.sendEmailChanged(ctx, oldEmail, user)
+			if err := app.sendEmailVerification(ctx, user); err != nil {
+				slog.ErrorContext(ctx, "failed to send the email verification email", "user_id", user.ID, "err", err)
+			}
+		})
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, user)
+}
+
+// sendEmailChanged lets the old address of user know it isn't theirs any
+// more, in case it wasn't them who changed it
+func (app *application) sendEmailChanged(ctx context.Context, oldEmail string, user *models.User) {
+	msg := mailer.Message{
+		To:      oldEmail,
+		Subject: "Your email address was changed",
+		Text: fmt.Sprintf("Hi %s,\n\n"+
+			"the email address of your account was changed to %s, we won't\n"+
+			"send anything to this one any more.\n\n"+
+			"If it wasn't you, reset your password and get in touch with us.\n",
+			user.FirstName, user.Email),
+	}
+	if err := app.mailer.Send(ctx, msg); err != nil {
+		slog.ErrorContext(ctx, "failed to send the email changed email", "user_id", user.ID, "err", err)
+	}
+}
+
+// path: POST /me/password
+// changes the password of the logged in user, who has to know the one
+// they have now. every session of the user ends, this one too
+func (app *application) ChangeMyPassword(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := app.readJSON(w, r, &payload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.requestUser(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	if problems := app.passwordPolicy.check(payload.NewPassword, user.Email); len(problems) > 0 {
+		app.errorJSON(w, errors.New(strings.Join(problems, ", ")), http.StatusUnprocessableEntity)
+		return
+	}
+	if !app.confirmUser(w, r, user, errInvalidCredentials, func() (bool, error) {
+		return user.PasswordMatches(payload.CurrentPassword)
+	}) {
+		return
+	}
+
+	passwordHash, err := hashPassword(payload.NewPassword)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := app.db(r).ChangePassword(user.ID, passwordHash); err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "password changed", "user_id", user.ID)
+
+	http.SetCookie(w, app.auth.GetExpiredRefreshCookie())
+	_ = app.writeJSON(w, http.StatusOK, JSONResponse{Message: "password changed, log in with the new password"})
+}
+
+// path: DELETE /me
+// deletes the account of the logged in user and everything that's theirs.
+// it takes the password, and a code when they have two-factor
+// authentication. the last admin can't delete themselves
+func (app *application) DeleteMe(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := app.readJSON(w, r, &payload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.requestUser(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	if user.MFAEnabled() {
+		if !app.checkSecondFactor(w, r, user, true, payload.Password, payload.Code) {
+			return
+		}
+	} else if !app.confirmUser(w, r, user, errInvalidCredentials, func() (bool, error) {
+		return user.PasswordMatches(payload.Password)
+	}) {
+		return
+	}
+
+	if err := app.db(r).DeleteUser(user.ID); err != nil {
+		if errors.Is(err, repository.ErrLastAdmin) {
+			app.errorJSON(w, err, http.StatusConflict)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "account deleted", "user_id", user.ID)
+
+	http.SetCookie(w, app.auth.GetExpiredRefreshCookie())
+	_ = app.writeJSON(w, http.StatusOK, JSONResponse{Message: "account deleted"})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"backend/internals/models"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// movieSnapshot gets a movie the way we want to remember it in the audit
+// trail: its fields plus the ids of its genres
+func (app *application) movieSnapshot(r *http.Request, id int) (*models.Movie, error) {
+	movie, err := app.db(r).OneMovie(id)
+	if err != nil {
+		return nil, err
+	}
+
+	movie.GenresArray = []int{}
+	for _, g := range movie.Genres {
+		movie.GenresArray = append(movie.GenresArray, g.ID)
+	}
+	sort.Ints(movie.GenresArray)
+	// we have the ids, the names would just add noise to the diff
+	movie.Genres = nil
+
+	return movie, nil
+}
+
+// recordAudit writes down who changed which movie and how.
+// the change has already been made at this point, so if we can't
+// write the entry we log it rather than fail the request
+func (app *application) recordAudit(r *http.Request, action string, movieID int, before, after *models.Movie) {
+	// the user id is the subject of the access token
+	userID := 0
+	if claims := claimsFromContext(r.Context()); claims != nil {
+		userID, _ = strconv.Atoi(claims.Subject)
+	}
+
+	app.writeAudit(r.Context(), userID, action, movieID, before, after)
+}
+
+// writeAudit is recordAudit for changes that don't come from a request,
+// like the background trash purge. a userID of 0 means "the system"
+func (app *application) writeAudit(ctx context.Context, userID int, action string, movieID int, before, after *models.Movie) {
+	entry := models.AuditEntry{
+		MovieID:   movieID,
+		UserID:    userID,
+		Action:    action,
+		CreatedAt: time.Now(),
+	}
+
+	var err error
+	if before != nil {
+		entry.Before, err = json.Marshal(before)
+		if err != nil {
+			slog.ErrorContext(ctx, "audit: failed to encode movie", "movie_id", movieID, "err", err)
+			return
+		}
+	}
+	if after != nil {
+		entry.After, err = json.Marshal(after)
+		if err != nil {
+			slog.ErrorContext(ctx, "audit: failed to encode movie", "movie_id", movieID, "err", err)
+			return
+		}
+	}
+	entry.Changes = diffJSON(entry.Before, entry.After)
+
+	err = app.DB.WithContext(ctx).InsertAuditEntry(entry)
+	if err != nil {
+		slog.ErrorContext(ctx, "audit: failed to record", "action", action, "movie_id", movieID, "err", err)
+	}
+}
+
+// diffJSON compares two JSON objects field by field and returns the
+// fields that are different
+func diffJSON(before, after json.RawMessage) map[string]models.FieldChange {
+	var b, a map[string]interface{}
+	if len(before) > 0 {
+		_ = json.Unmarshal(before, &b)
+	}
+	if len(after) > 0 {
+		_ = json.Unmarshal(after, &a)
+	}
+
+	changes := make(map[string]models.FieldChange)
+	for key, from := range b {
+		if to, ok := a[key]; !ok || !reflect.DeepEqual(from, to) {
+			changes[key] = models.FieldChange{From: from, To: a[key]}
+		}
+	}
+	for key, to := range a {
+		if _, ok := b[key]; !ok {
+			changes[key] = models.FieldChange{From: nil, To: to}
+		}
+	}
+
+	return changes
+}
@@ -8,7 +8,6 @@ package main
 import (
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
 	"time"
@@ -26,6 +25,9 @@ type Auth struct {
 	// sometimes as long as year, sometimes as short as two weeks
 	// it's entirely up to you
 	RefreshExpiry time.Duration // when does my refresh token expires
+	// how long a user who got their password right has to type the code
+	// from their authenticator app
+	MFATokenExpiry time.Duration
 	//we're goin to give our refresh tokens to users as cookie as HTTP only
 	// secure cookie, which is not accessible from javascript, but which
 	// will be included in any request made to our backend
@@ -35,6 +37,10 @@ type Auth struct {
 	CookieDomain string // i.e example.com
 	CookiePath   string // path to the cookie
 	CookieName   string
+	// a secure cookie is only sent over HTTPS, turn it off for plain
+	// http on localhost
+	CookieSecure   bool
+	CookieSameSite http.SameSite
 }
 
 // this type will only contain enough information
@@ -45,13 +51,22 @@ type jwtUser struct {
 	ID        int    `json:"id"`
 	FirstName string `json:"first_name"`
 	LastName  string `json:"last_name"`
+	// the token version of the user, see models.User
+	TokenVersion int `json:"-"`
+	// whether the user verified their email address
+	EmailVerified bool   `json:"-"`
+	Role          string `json:"-"`
+	// whether the user logged in with a second factor too
+	MFA bool `json:"-"`
 }
 
 // this type is we're going to issue our token as a pair
 type TokenPairs struct {
-	Token        string `json:"access_token"` // actual JWT token we issue
-	RefreshToken string `json:refresh_token"` // the refresh token
-
+	Token        string `json:"access_token"`  // actual JWT token we issue
+	RefreshToken string `json:"refresh_token"` // the refresh token
+	// the user logged in with a temporary password, the tokens only work
+	// for changing it
+	PasswordChangeRequired bool `json:"password_change_required,omitempty"`
 }
 
 // everytime you have a jwt issue, that jwt has certain things that are
@@ -64,6 +79,19 @@ type TokenPairs struct {
 // but you can put other information in.
 type Claims struct {
 	jwt.RegisteredClaims
+	// the token version of the user when the token was issued. a refresh
+	// token with an older version than the user's has been revoked
+	TokenVersion int `json:"ver"`
+	// whether the user had verified their email address when the access
+	// token was issued. after verifying, /refresh gives a token saying so
+	EmailVerified bool   `json:"email_verified"`
+	Role          string `json:"role"`
+	// whether the session was logged in with a code from an authenticator
+	// app (or a recovery code) on top of the password. refresh tokens
+	// carry it over to the access tokens they get
+	MFA bool `json:"mfa"`
+	// "JWT" for access tokens, "mfa" for the MFA challenge tokens
+	Type string `json:"typ"`
 }
 
 // generate token pair and that will generate a JWT and the refresh token
@@ -83,6 +111,12 @@ func (j *Auth) GenerateTokenPair(user *jwtUser) (TokenPairs, error) {
 	claims["iss"] = j.Issuer                // issuer
 	claims["iat"] = time.Now().UTC().Unix() // when was this issued?
 	claims["typ"] = "JWT"
+	claims["email_verified"] = user.EmailVerified
+	claims["role"] = user.Role
+	claims["mfa"] = user.MFA
+	// authRequired compares this with the user, so logging a user out
+	// everywhere ends their access tokens too, not only the refresh ones
+	claims["ver"] = user.TokenVersion
 
 	// Set the expiry for JWT
 	claims["exp"] = time.Now().UTC().Add(j.TokenExpiry).Unix()
@@ -90,7 +124,6 @@ func (j *Auth) GenerateTokenPair(user *jwtUser) (TokenPairs, error) {
 	// Create a signed token
 	signedAccessToken, err := token.SignedString([]byte(j.Secret))
 	if err != nil {
-		log.Println("error in Create a signed token")
 		return TokenPairs{}, err
 	}
 
@@ -99,6 +132,8 @@ func (j *Auth) GenerateTokenPair(user *jwtUser) (TokenPairs, error) {
 	refreshTokenClaims := refreshToken.Claims.(jwt.MapClaims)
 	refreshTokenClaims["sub"] = fmt.Sprint(user.ID) // userid in Database
 	refreshTokenClaims["iat"] = time.Now().UTC().Unix()
+	refreshTokenClaims["ver"] = user.TokenVersion
+	refreshTokenClaims["mfa"] = user.MFA
 
 	// Set the expiry for the refresh token
 	refreshTokenClaims["exp"] = time.Now().UTC().Add(j.RefreshExpiry).Unix()
@@ -106,7 +141,6 @@ func (j *Auth) GenerateTokenPair(user *jwtUser) (TokenPairs, error) {
 	// Create signed refresh token
 	signedRefreshToken, err := refreshToken.SignedString([]byte(j.Secret))
 	if err != nil {
-		log.Println("error in create signed refresh token")
 		return TokenPairs{}, err
 	}
 
@@ -121,6 +155,41 @@ func (j *Auth) GenerateTokenPair(user *jwtUser) (TokenPairs, error) {
 
 }
 
+// GenerateMFAToken makes the token a user who got their password right
+// sends back with the code from their authenticator app. it has no issuer
+// (like a refresh token), so it can't pass for an access token
+func (j *Auth) GenerateMFAToken(user *jwtUser) (string, error) {
+	token := jwt.New(jwt.SigningMethodHS256)
+	claims := token.Claims.(jwt.MapClaims)
+	claims["sub"] = fmt.Sprint(user.ID)
+	claims["aud"] = j.Audience
+	claims["iat"] = time.Now().UTC().Unix()
+	claims["exp"] = time.Now().UTC().Add(j.MFATokenExpiry).Unix()
+	claims["ver"] = user.TokenVersion
+	claims["typ"] = mfaTokenType
+
+	return token.SignedString([]byte(j.Secret))
+}
+
+// ParseMFAToken checks a token from GenerateMFAToken and gives back its
+// claims
+func (j *Auth) ParseMFAToken(token string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method:%v", token.Header["alg"])
+		}
+		return []byte(j.Secret), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if claims.Type != mfaTokenType || !claims.VerifyAudience(j.Audience, true) {
+		return nil, errors.New("not an mfa token")
+	}
+	return claims, nil
+}
+
 func (j *Auth) GetRefreshCookie(refreshToken string) *http.Cookie {
 	return &http.Cookie{
 		Name:     j.CookieName,
@@ -128,11 +197,11 @@ func (j *Auth) GetRefreshCookie(refreshToken string) *http.Cookie {
 		Value:    refreshToken,
 		Expires:  time.Now().Add(j.RefreshExpiry),
 		MaxAge:   int(j.RefreshExpiry.Seconds()),
-		SameSite: http.SameSiteStrictMode, // make this cookie limited to this site
+		SameSite: j.CookieSameSite, // make this cookie limited to this site
 		Domain:   j.CookieDomain,
 		// these make the cookie more secure
 		HttpOnly: true, // so javascript will have no access to this cookie in a web browser
-		Secure:   true,
+		Secure:   j.CookieSecure,
 	}
 }
 
@@ -144,11 +213,11 @@ func (j *Auth) GetExpiredRefreshCookie() *http.Cookie {
 		Value:    "",
 		Expires:  time.Unix(0, 0),
 		MaxAge:   -1,
-		SameSite: http.SameSiteStrictMode, // make this cookie limited to this site
+		SameSite: j.CookieSameSite, // make this cookie limited to this site
 		Domain:   j.CookieDomain,
 		// these make the cookie more secure
 		HttpOnly: true, // so javascript will have no access to this cookie in a web browser
-		Secure:   true,
+		Secure:   j.CookieSecure,
 	}
 }
 
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"backend/internals/models"
+	"backend/internals/repository"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// movieETag identifies one version of a movie. every change to a movie
+// sets updated_at, so the id and updated_at together change whenever the
+// movie does. this is the tag of the JSON, render gives the other formats
+// their own with representationETag
+func movieETag(movie *models.Movie) string {
+	return fmt.Sprintf(`"%d-%x"`, movie.ID, movie.UpdateAt.UnixNano())
+}
+
+// representationETag turns the tag of the JSON of something into the tag
+// of it in another format. a strong ETag promises the exact same bytes, so
+// the CSV of a movie can't have the tag of its JSON
+// ("12-abc" becomes "12-abc-csv")
+func representationETag(etag, contentType string) string {
+	typ := mediaType(contentType)
+	if typ == "application/json" || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	_, subtype, _ := strings.Cut(typ, "/")
+	subtype = strings.TrimPrefix(subtype, "x-")
+	return strings.TrimSuffix(etag, `"`) + "-" + subtype + `"`
+}
+
+// contentETag is for things that don't have an updated_at of their own,
+// like a list, we hash exactly what we're about to send
+func contentETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// setLastModified sets the Last-Modified header, if we know when
+func setLastModified(w http.ResponseWriter, t time.Time) {
+	if !t.IsZero() {
+		w.Header().Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified checks a GET against the ETag and Last-Modified headers
+// we've set, and tells us whether the client already has this version
+// (RFC 9110 section 13.2.2: If-None-Match wins over If-Modified-Since)
+func notModified(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		// If-None-Match uses the weak comparison, W/ doesn't matter
+		etag := strings.TrimPrefix(w.Header().Get("ETag"), "W/")
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || (etag != "" && tag == etag) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		lastModified, err := http.ParseTime(w.Header().Get("Last-Modified"))
+		if err != nil {
+			return false
+		}
+		return !lastModified.After(since)
+	}
+
+	return false
+}
+
+// writeNotModified sends a 304. the body is left out, but the validators
+// stay so the client can update its cached copy
+func writeNotModified(w http.ResponseWriter) {
+	w.Header().Del("Content-Type")
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// checkIfMatch makes changes to a movie conditional on the client having
+// seen the latest version. the client must send the ETag it got in
+// If-Match, if someone else changed the movie in the meantime the tags
+// won't match and we refuse with 412, so nobody overwrites somebody
+// else's changes without knowing. returns false when it has already
+// written the response. somebody can still get in between this and the
+// write, so the write is conditional on the same version too
+// (repository.ErrMovieChanged)
+func (app *application) checkIfMatch(w http.ResponseWriter, r *http.Request, movie *models.Movie) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		app.errorJSON(w, errors.New("this request needs an If-Match header with the movie's ETag"), http.StatusPreconditionRequired)
+		return false
+	}
+
+	// If-Match uses the strong comparison, a weak tag never matches
+	etag := movieETag(movie)
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+
+	w.Header().Set("ETag", etag)
+	app.errorJSON(w, repository.ErrMovieChanged, http.StatusPreconditionFailed)
+	return false
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// every setting can come from four places. when a setting is given in more
+// than one, the first of these wins:
+//
+//  1. a command line flag, -jwt-secret=...
+//  2. an environment variable, MOVIES_JWT_SECRET=...
+//     or MOVIES_JWT_SECRET_FILE=/run/secrets/jwt to read it from a file
+//  3. the YAML config file given with -config (or MOVIES_CONFIG)
+//  4. the default of the flag
+//
+// the flags are the list of settings, so a new setting only has to be
+// declared as a flag to be readable from everywhere else too
+const envPrefix = "MOVIES_"
+
+// the environments we know about. only dev is allowed to run with the
+// default secrets, and only with -dev-secrets
+const (
+	envDevelopment = "dev"
+	envStaging     = "staging"
+	envProduction  = "production"
+)
+
+// the default secrets, good enough on a laptop and nowhere else
+const (
+	defaultJWTSecret = "verysecret"
+	defaultDSN       = "host=localhost port=5432 user=postgres password=postgres dbname=movies sslmode=disable timezone=UTC connect_timeout=5"
+)
+
+// loadConfig fills in the flags of fs from the command line, the
+// environment and the config file
+func loadConfig(fs *flag.FlagSet, args []string) error {
+	configPath := fs.String("config", "", "path to a YAML config file, can also be set with "+envPrefix+"CONFIG")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// flags given on the command line beat everything else, so we
+	// remember them and don't touch them again
+	fromCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		fromCommandLine[f.Name] = true
+	})
+
+	if *configPath == "" {
+		*configPath = os.Getenv(envPrefix + "CONFIG")
+	}
+
+	// the file first, so the environment can overwrite it
+	if *configPath != "" {
+		values, err := readConfigFile(*configPath)
+		if err != nil {
+			return err
+		}
+		for name, value := range values {
+			// name_file: /path works in the file too
+			if strings.HasSuffix(name, "-file") && fs.Lookup(name) == nil {
+				name = strings.TrimSuffix(name, "-file")
+				if value, err = readSecretFile(value); err != nil {
+					return fmt.Errorf("config %s: %w", name, err)
+				}
+			}
+			if fs.Lookup(name) == nil {
+				return fmt.Errorf("config file %s: unknown setting %q", *configPath, name)
+			}
+			if fromCommandLine[name] {
+				continue
+			}
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("config file %s: %s: %w", *configPath, name, err)
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || fromCommandLine[f.Name] || f.Name == "config" {
+			return
+		}
+
+		key := envName(f.Name)
+		value, ok := os.LookupEnv(key)
+		if path, fromFile := os.LookupEnv(key + "_FILE"); fromFile {
+			if ok {
+				err = fmt.Errorf("both %s and %s_FILE are set", key, key)
+				return
+			}
+			if value, err = readSecretFile(path); err != nil {
+				err = fmt.Errorf("%s_FILE: %w", key, err)
+				return
+			}
+			ok = true
+		}
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%s: %w", key, setErr)
+		}
+	})
+	return err
+}
+
+// envName turns a flag name into the environment variable for it,
+// jwt-secret becomes MOVIES_JWT_SECRET
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// readSecretFile reads a secret mounted as a file (a docker or kubernetes
+// secret). the trailing newline most editors add isn't part of the secret
+func readSecretFile(path string) (string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(raw), "\r\n"), nil
+}
+
+// readConfigFile reads a YAML file into flag name => value. nested keys
+// are joined with a dash, so
+//
+//	jwt:
+//	  secret: abc
+//
+// is the same as jwt-secret: abc. lists become comma separated values
+func readConfigFile(path string) (map[string]string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("reading config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	if err := flattenConfig("", doc, values); err != nil {
+		return nil, fmt.Errorf("reading config file %s: %w", path, err)
+	}
+	return values, nil
+}
+
+func flattenConfig(prefix string, doc map[string]interface{}, values map[string]string) error {
+	for key, value := range doc {
+		name := strings.ToLower(strings.ReplaceAll(key, "_", "-"))
+		if prefix != "" {
+			name = prefix + "-" + name
+		}
+
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if err := flattenConfig(name, v, values); err != nil {
+				return err
+			}
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				if _, ok := item.(map[string]interface{}); ok {
+					return fmt.Errorf("%s: lists can only hold plain values", name)
+				}
+				items[i] = fmt.Sprint(item)
+			}
+			values[name] = strings.Join(items, ",")
+		case nil:
+			values[name] = ""
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+// validate checks the settings once they're all loaded. we refuse to
+// start with a secret anybody can read in our source code, unless it's dev
+// and -dev-secrets asks for it: env defaults to dev, a deployment that
+// forgets to set it mustn't end up signing tokens with "verysecret"
+func (app *application) validate() error {
+	var problems []string
+
+	switch app.Env {
+	case envDevelopment, envStaging, envProduction:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown env %q (dev|staging|production)", app.Env))
+	}
+
+	if app.DevSecrets && app.Env != envDevelopment {
+		problems = append(problems, "dev-secrets only works with env dev")
+	}
+	devSecrets := app.DevSecrets && app.Env == envDevelopment
+	if app.JWTSecret == "" {
+		problems = append(problems, "jwt-secret must be set to a secret of your own")
+	} else if app.JWTSecret == defaultJWTSecret && !devSecrets {
+		problems = append(problems, "jwt-secret must be set to a secret of your own (or -dev-secrets with env dev on a laptop)")
+	} else if app.Env != envDevelopment && len(app.JWTSecret) < 32 {
+		problems = append(problems, "jwt-secret must be at least 32 characters")
+	}
+	if app.DSN == defaultDSN && !devSecrets {
+		problems = append(problems, "dsn must be set, the default uses the default postgres password (or -dev-secrets with env dev on a laptop)")
+	}
+	if app.Env == envProduction && app.Mailer != mailerSMTP {
+		problems = append(problems, "production needs mailer smtp, users never get emails written to a file or the log")
+	}
+
+	if app.Port < 1 || app.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("port %d is out of range", app.Port))
+	}
+	if app.auth.TokenExpiry <= 0 || app.auth.RefreshExpiry <= 0 {
+		problems = append(problems, "token-expiry and refresh-expiry must be positive")
+	} else if app.auth.RefreshExpiry < app.auth.TokenExpiry {
+		problems = append(problems, "refresh-expiry must be longer than token-expiry")
+	}
+	// browsers only accept a __Host- cookie that is secure, has no
+	// domain and a path of /
+	if strings.HasPrefix(app.auth.CookieName, "__Host-") &&
+		(app.auth.CookiePath != "/" || app.auth.CookieDomain != "" || !app.auth.CookieSecure) {
+		problems = append(problems, "a __Host- cookie needs cookie-path /, no cookie-domain and cookie-secure")
+	}
+	if app.auth.CookieSameSite == http.SameSiteNoneMode && !app.auth.CookieSecure {
+		problems = append(problems, "cookie-samesite none needs cookie-secure")
+	}
+	if app.ReadHeaderTimeout < 0 || app.ReadTimeout < 0 || app.WriteTimeout < 0 || app.IdleTimeout < 0 || app.ShutdownTimeout < 0 {
+		problems = append(problems, "server timeouts can't be negative")
+	}
+	if app.DBMaxOpenConns < 0 || app.DBMaxIdleConns < 0 {
+		problems = append(problems, "db pool sizes can't be negative")
+	}
+	if app.RateLimitStore != rateLimitStoreMemory && app.RateLimitStore != rateLimitStorePostgres {
+		problems = append(problems, fmt.Sprintf("unknown rate-limit-store %q (memory|postgres)", app.RateLimitStore))
+	}
+	if app.RateLimit.Requests < 0 || app.AuthRateLimit.Requests < 0 {
+		problems = append(problems, "rate limits can't be negative")
+	}
+	if (app.RateLimit.Requests > 0 && app.RateLimit.Period <= 0) || (app.AuthRateLimit.Requests > 0 && app.AuthRateLimit.Period <= 0) {
+		problems = append(problems, "rate limit periods must be positive")
+	}
+	if app.lockout.Threshold > 0 && (app.lockout.Duration <= 0 || app.lockout.Max < app.lockout.Duration || app.lockout.Window <= 0) {
+		problems = append(problems, "login lockout needs a positive duration and window, and a max at least as long as the duration")
+	}
+	if u, err := url.Parse(app.FrontendURL); err != nil || u.Scheme == "" || u.Host == "" {
+		problems = append(problems, "frontend-url must be an absolute URL")
+	}
+	if app.PasswordResetExpiry <= 0 {
+		problems = append(problems, "password-reset-expiry must be positive")
+	}
+	if app.EmailVerifyExpiry <= 0 {
+		problems = append(problems, "email-verify-expiry must be positive")
+	}
+	if app.VerifyResendLimit.Requests < 0 || (app.VerifyResendLimit.Requests > 0 && app.VerifyResendLimit.Period <= 0) {
+		problems = append(problems, "verify-resend-requests can't be negative and verify-resend-period must be positive")
+	}
+	if app.MFAIssuer == "" || strings.Contains(app.MFAIssuer, ":") {
+		problems = append(problems, "mfa-issuer can't be empty or contain a colon")
+	}
+	if app.auth.MFATokenExpiry <= 0 {
+		problems = append(problems, "mfa-token-expiry must be positive")
+	}
+	if app.passwordPolicy.MinLength < 8 || app.passwordPolicy.MinLength > maxPasswordBytes {
+		problems = append(problems, fmt.Sprintf("password-min-length must be between 8 and %d", maxPasswordBytes))
+	}
+	if _, err := mail.ParseAddress(app.MailFrom); err != nil {
+		problems = append(problems, "mail-from must be an email address")
+	}
+	switch app.Mailer {
+	case mailerLog:
+	case mailerFile:
+		if app.MailFile == "" {
+			problems = append(problems, "mailer file needs a mail-file")
+		}
+	case mailerSMTP:
+		if app.SMTPHost == "" {
+			problems = append(problems, "mailer smtp needs an smtp-host")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown mailer %q (smtp|file|log)", app.Mailer))
+	}
+	switch app.TraceExporter {
+	case traceExporterNone, traceExporterStdout:
+	case traceExporterFile:
+		if app.TraceFile == "" {
+			problems = append(problems, "trace-exporter file needs a trace-file")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown trace-exporter %q (none|stdout|file)", app.TraceExporter))
+	}
+	if app.TraceSampleRatio < 0 || app.TraceSampleRatio > 1 {
+		problems = append(problems, "trace-sample-ratio must be between 0 and 1")
+	}
+	if app.GraphQLMode != graphQLModeOpen && app.GraphQLMode != graphQLModeAllowList {
+		problems = append(problems, fmt.Sprintf("unknown graphql mode %q", app.GraphQLMode))
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testFlags is a small set of settings like the ones main declares
+func testFlags() (*flag.FlagSet, map[string]*string) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	values := make(map[string]*string)
+	for _, name := range []string{"env", "port", "jwt-secret", "jwt-issuer", "cors-allowed-origins"} {
+		values[name] = fs.String(name, "default-"+name, "")
+	}
+	return fs, values
+}
+
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	config := writeTestFile(t, "config.yml", `
+env: staging
+port: 9000
+jwt:
+  secret: from-file
+  issuer: from-file
+cors:
+  allowed_origins:
+    - https://a.example.com
+    - https://b.example.com
+`)
+	t.Setenv("MOVIES_PORT", "9100")
+	t.Setenv("MOVIES_JWT_SECRET", "from-env")
+
+	fs, values := testFlags()
+	if err := loadConfig(fs, []string{"-config", config, "-jwt-secret", "from-flag"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"env":                  "staging",                                     // the file
+		"port":                 "9100",                                        // the environment beats the file
+		"jwt-secret":           "from-flag",                                   // the command line beats both
+		"jwt-issuer":           "from-file",                                   // nested keys
+		"cors-allowed-origins": "https://a.example.com,https://b.example.com", // lists
+	}
+	for name, value := range want {
+		if *values[name] != value {
+			t.Errorf("%s: got %q, want %q", name, *values[name], value)
+		}
+	}
+}
+
+func TestLoadConfigDefaultsAndConfigFromEnv(t *testing.T) {
+	config := writeTestFile(t, "config.yml", "jwt_issuer: from-file\n")
+	t.Setenv("MOVIES_CONFIG", config)
+
+	fs, values := testFlags()
+	if err := loadConfig(fs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if *values["jwt-issuer"] != "from-file" {
+		t.Errorf("jwt-issuer: got %q, MOVIES_CONFIG wasn't read", *values["jwt-issuer"])
+	}
+	if *values["port"] != "default-port" {
+		t.Errorf("port: got %q, want the default", *values["port"])
+	}
+}
+
+func TestLoadConfigSecretFiles(t *testing.T) {
+	secret := writeTestFile(t, "jwt_secret", "from-secret-file\n")
+	issuer := writeTestFile(t, "issuer", "issuer-from-file\r\n")
+	config := writeTestFile(t, "config.yml", "jwt:\n  issuer_file: "+issuer+"\n")
+	t.Setenv("MOVIES_JWT_SECRET_FILE", secret)
+
+	fs, values := testFlags()
+	if err := loadConfig(fs, []string{"-config", config}); err != nil {
+		t.Fatal(err)
+	}
+	if *values["jwt-secret"] != "from-secret-file" {
+		t.Errorf("jwt-secret: got %q", *values["jwt-secret"])
+	}
+	if *values["jwt-issuer"] != "issuer-from-file" {
+		t.Errorf("jwt-issuer: got %q", *values["jwt-issuer"])
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	t.Run("unknown setting", func(t *testing.T) {
+		config := writeTestFile(t, "config.yml", "jwt_sekret: typo\n")
+		fs, _ := testFlags()
+		err := loadConfig(fs, []string{"-config", config})
+		if err == nil || !strings.Contains(err.Error(), "jwt-sekret") {
+			t.Errorf("got %v, want an error about jwt-sekret", err)
+		}
+	})
+	t.Run("value and file", func(t *testing.T) {
+		t.Setenv("MOVIES_JWT_SECRET", "a")
+		t.Setenv("MOVIES_JWT_SECRET_FILE", writeTestFile(t, "secret", "b"))
+		fs, _ := testFlags()
+		if err := loadConfig(fs, nil); err == nil {
+			t.Error("both MOVIES_JWT_SECRET and MOVIES_JWT_SECRET_FILE were accepted")
+		}
+	})
+	t.Run("lists of objects", func(t *testing.T) {
+		config := writeTestFile(t, "config.yml", "cors:\n  allowed_origins:\n    - host: a\n")
+		fs, _ := testFlags()
+		if err := loadConfig(fs, []string{"-config", config}); err == nil {
+			t.Error("a list of objects was accepted")
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the response headers the front end is allowed to read, like the
+// validators it needs for If-Match
+var corsExposedHeaders = []string{"ETag", "Last-Modified", "Location", "Deprecation", "Sunset", "Link", "Idempotent-Replayed", "API-Version", "X-Request-ID", "Retry-After", "X-RateLimit-Limit", "X-RateLimit-Remaining"}
+
+// CORS decides which web sites can call the API from a browser, and what
+// they're allowed to send
+type CORS struct {
+	// either exact origins ("https://movies.example.com") or patterns
+	// where * stands for any part of the host or port
+	// ("https://*.example.com", "http://localhost:*"). a lone "*"
+	// allows every web site, which is only allowed without credentials
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+	// whether browsers should send cookies (our refresh token) and the
+	// Authorization header along
+	AllowCredentials bool
+	// how long a browser can cache the answer to a preflight request
+	MaxAge time.Duration
+}
+
+// origins no allow-list should have on it, an origin pattern matching one
+// of them matches every web site
+var anyOrigins = []string{
+	"https://any-origin.invalid", "http://any-origin.invalid",
+	"https://any-origin.invalid:8443", "http://any-origin.invalid:8080",
+}
+
+// Validate checks that every origin pattern can actually be matched, and
+// that every web site isn't allowed to call us with the refresh cookie:
+// we echo the origin back, so a browser would let any page do that
+func (c *CORS) Validate() error {
+	for _, origin := range c.AllowedOrigins {
+		if _, err := path.Match(origin, ""); err != nil {
+			return fmt.Errorf("cors: bad origin pattern %q", origin)
+		}
+		if !c.AllowCredentials {
+			continue
+		}
+		matchesAny := origin == "*"
+		for _, other := range anyOrigins {
+			if ok, _ := path.Match(strings.ToLower(origin), other); ok {
+				matchesAny = true
+			}
+		}
+		if matchesAny {
+			return fmt.Errorf("cors: origin %q allows every web site, that can't go with credentials", origin)
+		}
+	}
+	return nil
+}
+
+// originAllowed tells us whether an Origin header is on the allow-list
+func (c *CORS) originAllowed(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if ok, _ := path.Match(strings.ToLower(allowed), strings.ToLower(origin)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) methodAllowed(method string) bool {
+	// the simple methods are always allowed, browsers don't even ask
+	if method == http.MethodGet || method == http.MethodHead || method == http.MethodPost {
+		return true
+	}
+	for _, allowed := range c.AllowedMethods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// headersAllowed checks the comma separated list in
+// Access-Control-Request-Headers
+func (c *CORS) headersAllowed(requested string) bool {
+	for _, header := range splitList(requested) {
+		ok := false
+		for _, allowed := range c.AllowedHeaders {
+			if allowed == "*" || strings.EqualFold(allowed, header) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// sameOrigin tells us whether the browser is calling us from a page we
+// served ourselves, that isn't a cross-origin request at all
+func sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+var errOriginNotAllowed = errors.New("origin not allowed")
+
+// splitList turns "a, b,c" into [a b c], skipping empty entries
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// setPreflightHeaders answers a preflight request for an allowed origin
+func (c *CORS) setPreflightHeaders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+
+	// browsers don't take "*" as a wildcard when credentials are allowed,
+	// so we name the headers they asked for instead
+	allowedHeaders := strings.Join(c.AllowedHeaders, ", ")
+	for _, allowed := range c.AllowedHeaders {
+		if allowed == "*" {
+			allowedHeaders = r.Header.Get("Access-Control-Request-Headers")
+			break
+		}
+	}
+	if allowedHeaders != "" {
+		w.Header().Set("Access-Control-Allow-Headers", allowedHeaders)
+	}
+	if c.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+}
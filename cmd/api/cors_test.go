@@ -0,0 +1,77 @@
+package main
+
+import "testing"
+
+func TestCORSValidate(t *testing.T) {
+	tests := []struct {
+		origins     []string
+		credentials bool
+		ok          bool
+	}{
+		{[]string{"https://movies.example.com"}, true, true},
+		{[]string{"https://*.example.com", "http://localhost:*"}, true, true},
+		{[]string{"*"}, false, true},
+		{[]string{"https://*"}, false, true},
+		{[]string{"*"}, true, false},
+		{[]string{"https://movies.example.com", "https://*"}, true, false},
+		{[]string{"http*://*"}, true, false},
+		{[]string{"http://*:*"}, true, false},
+		{[]string{"*://*"}, true, false},
+		{[]string{"https://[movies.example.com"}, false, false},
+	}
+	for _, tt := range tests {
+		c := CORS{AllowedOrigins: tt.origins, AllowCredentials: tt.credentials}
+		if err := c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%q with credentials %v: got %v", tt.origins, tt.credentials, err)
+		}
+	}
+}
+
+func TestCORSOriginAllowed(t *testing.T) {
+	c := CORS{AllowedOrigins: []string{"https://movies.example.com", "https://*.preview.example.com", "http://localhost:*"}}
+
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"https://movies.example.com", true},
+		{"HTTPS://MOVIES.EXAMPLE.COM", true},
+		{"http://movies.example.com", false},
+		{"https://movies.example.com.evil.com", false},
+		{"https://pr-12.preview.example.com", true},
+		{"https://preview.example.com", false},
+		{"https://evilpreview.example.com", false},
+		{"http://localhost:3000", true},
+		{"http://localhost", false},
+		{"http://localhost.evil.com:3000", false},
+		{"null", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := c.originAllowed(tt.origin); got != tt.ok {
+			t.Errorf("%q: got %v, want %v", tt.origin, got, tt.ok)
+		}
+	}
+
+	everybody := CORS{AllowedOrigins: []string{"*"}}
+	if !everybody.originAllowed("https://anything.example.org") {
+		t.Error(`"*" didn't allow every origin`)
+	}
+}
+
+func TestCORSMethodsAndHeaders(t *testing.T) {
+	c := CORS{
+		AllowedMethods: []string{"PUT", "PATCH"},
+		AllowedHeaders: []string{"Content-Type", "Authorization"},
+	}
+	for method, ok := range map[string]bool{"GET": true, "POST": true, "patch": true, "DELETE": false} {
+		if got := c.methodAllowed(method); got != ok {
+			t.Errorf("method %s: got %v, want %v", method, got, ok)
+		}
+	}
+	for headers, ok := range map[string]bool{"": true, "content-type, Authorization": true, "Content-Type, X-Evil": false} {
+		if got := c.headersAllowed(headers); got != ok {
+			t.Errorf("headers %q: got %v, want %v", headers, got, ok)
+		}
+	}
+}
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"backend/internals/migrations"
+	"context"
 	"database/sql"
-	"log"
+	"log/slog"
 
 	_ "github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v4"
 	_ "github.com/jackc/pgx/v4/stdlib"
 )
 
+// the version of the database schema this build works with, the last of
+// internals/migrations. a change to the schema is a new migration there,
+// and the same change in sql/create_tables.sql along with the version in
+// schema_migrations. /readyz fails when the database is at another version
+var schemaVersion = migrations.Latest()
+
 func openDB(dsn string) (*sql.DB, error) {
 	// *sql.DB pointer to a pool of database connections
 	// go's driver for sql is smart enough to open a connection pool
@@ -34,6 +42,24 @@ func (app *application) connectToDB() (*sql.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	log.Println("connected to postgres!")
+	// how many connections the pool keeps, and for how long
+	connection.SetMaxOpenConns(app.DBMaxOpenConns)
+	connection.SetMaxIdleConns(app.DBMaxIdleConns)
+	connection.SetConnMaxLifetime(app.DBConnMaxLifetime)
+	connection.SetConnMaxIdleTime(app.DBConnMaxIdleTime)
+
+	slog.Info("connected to postgres!")
 	return connection, nil
 }
+
+// migrate applies the migrations the database doesn't have yet
+func (app *application) migrate(ctx context.Context, db *sql.DB) error {
+	from, to, err := migrations.Up(ctx, db)
+	if err != nil {
+		return err
+	}
+	if from != to {
+		slog.Info("migrated the database schema", "from", from, "to", to)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"backend/internals/models"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// flush what we've written to the client every this many movies,
+// so a big export starts arriving straight away
+const exportFlushEvery = 100
+
+// an export streams for as long as the database query is allowed to run,
+// that's much longer than the server's WriteTimeout
+const exportWriteTimeout = 5 * time.Minute
+
+// exportRecord is how a movie looks in an export. the field names match
+// the import, so an exported file can be edited and imported again
+type exportRecord struct {
+	ID          int       `json:"id"`
+	ExternalID  string    `json:"external_id,omitempty"`
+	Title       string    `json:"title"`
+	ReleaseDate string    `json:"release_date"`
+	RunTime     int       `json:"runtime"`
+	MPAARating  string    `json:"mpaa_rating"`
+	Description string    `json:"description"`
+	Image       string    `json:"image"`
+	Genres      []string  `json:"genres"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func newExportRecord(movie *models.Movie) exportRecord {
+	rec := exportRecord{
+		ID:          movie.ID,
+		ExternalID:  movie.ExternalID,
+		Title:       movie.Title,
+		ReleaseDate: movie.ReleaseDate.Format("2006-01-02"),
+		RunTime:     movie.RunTime,
+		MPAARating:  movie.MPAARating,
+		Description: movie.Description,
+		Image:       movie.Image,
+		Genres:      []string{},
+		CreatedAt:   movie.CreatedAt,
+		UpdatedAt:   movie.UpdateAt,
+	}
+	for _, g := range movie.Genres {
+		rec.Genres = append(rec.Genres, g.Genre)
+	}
+	return rec
+}
+
+// the formats an export can be in, the first one is the default. it goes
+// through the same renderers as the rest of the API, so a movie in an
+// export looks the way it does everywhere else
+var exportFormats = []string{"json", "csv", "ndjson"}
+
+func exportRenderer(format string) (renderer, error) {
+	if format == "" {
+		format = exportFormats[0]
+	}
+	for _, name := range exportFormats {
+		if name != format {
+			continue
+		}
+		for _, rd := range renderers {
+			if rd.Extension() == format {
+				return rd, nil
+			}
+		}
+	}
+	return nil, errors.New("format must be one of csv, ndjson or json")
+}
+
+// exportFilter reads the optional filters from the query string:
+// genre_id, mpaa_rating (comma separated), year_from, year_to
+// and updated_since (RFC 3339, for picking up only what changed)
+func exportFilter(r *http.Request) (models.MovieFilter, error) {
+	qs := r.URL.Query()
+	var f models.MovieFilter
+	var err error
+
+	atoi := func(name string) int {
+		if err != nil || qs.Get(name) == "" {
+			return 0
+		}
+		var n int
+		n, err = strconv.Atoi(qs.Get(name))
+		if err != nil {
+			err = errors.New(name + " must be a number")
+		}
+		return n
+	}
+	f.GenreID = atoi("genre_id")
+	f.YearFrom = atoi("year_from")
+	f.YearTo = atoi("year_to")
+	if err != nil {
+		return f, err
+	}
+
+	if ratings := qs.Get("mpaa_rating"); ratings != "" {
+		f.MPAARatings = strings.Split(ratings, ",")
+	}
+	if since := qs.Get("updated_since"); since != "" {
+		f.UpdatedSince, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return f, errors.New("updated_since must be an RFC 3339 time")
+		}
+	}
+
+	return f, nil
+}
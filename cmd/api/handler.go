@@ -1,18 +1,23 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"backend/internals/graph"
 	"backend/internals/models"
+	"backend/internals/repository"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/golang-jwt/jwt/v4"
@@ -31,27 +36,39 @@ func (app *application) Home(w http.ResponseWriter, r *http.Request) {
 	// this is what we're going to send back
 	var payload = struct {
 		// specifiying the fields
-		Status  string `json:"status"`
-		Message string `json:"message"`
-		Version string `json:"version"`
+		Status     string `json:"status"`
+		Message    string `json:"message"`
+		Version    string `json:"version"`
+		APIVersion string `json:"api_version"`
+		Commit     string `json:"commit,omitempty"`
+		BuildTime  string `json:"build_time,omitempty"`
 	}{
-		Status:  "active",
-		Message: "Go Movies up and running",
-		Version: "1.0.0",
+		Status:     "active",
+		Message:    "Go Movies up and running",
+		Version:    version,
+		APIVersion: apiVersionFromContext(r.Context()),
+		Commit:     commit,
+		BuildTime:  buildTime,
 	}
 
 	_ = app.writeJSON(w, http.StatusOK, &payload)
 
 }
 
+// the client picks JSON, CSV, XML or NDJSON with the Accept header
 func (app *application) AllMovie(w http.ResponseWriter, r *http.Request) {
-	movies, err := app.DB.AllMovie()
+	movies, err := app.db(r).AllMovie()
 	if err != nil {
 		app.errorJSON(w, err) // badRequst
 		return
 	}
 
-	_ = app.writeJSON(w, http.StatusOK, movies)
+	lastModified, err := app.db(r).MoviesLastModified()
+	if err == nil {
+		setLastModified(w, lastModified)
+	}
+
+	_ = app.render(w, r, http.StatusOK, "movie", movies)
 }
 
 func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
@@ -62,32 +79,77 @@ func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
 		Email    string `json:"email"`
 		Password string `json:"password"`
 	}
-	fmt.Println("/authenticate got hit.")
 	err := app.readJSON(w, r, &requestPayload) // ==> &requestPayload is very important
 	if err != nil {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		return
 	}
 
+	// somebody guessing the password of this account has to wait
+	ctx := r.Context()
+	if wait, err := app.lockedOut(ctx, requestPayload.Email); err != nil {
+		slog.WarnContext(ctx, "failed to check the login lockout", "err", err)
+	} else if wait > 0 {
+		authLogins.WithLabelValues("locked").Inc()
+		app.tooManyRequests(w, errLockedOut, wait)
+		return
+	}
+
 	// validate user against database
-	user, err := app.DB.GetUserByEmail(requestPayload.Email)
+	// when nobody has the address we still check the password, against a
+	// hash nothing matches, so the answer takes as long as it does for a
+	// wrong password and the timing doesn't tell which addresses exist
+	user, err := app.db(r).GetUserByEmail(requestPayload.Email)
 	if err != nil {
-		app.errorJSON(w, errors.New("invalid credentials"), http.StatusBadRequest)
-		return
+		user = &models.User{Password: dummyPasswordHash}
 	}
 
 	//check password
-	valid, err := user.PasswordMatches(requestPayload.Password)
-	if err != nil || !valid {
-		app.errorJSON(w, errors.New("invalid credentials"), http.StatusBadRequest)
+	valid, matchErr := user.PasswordMatches(requestPayload.Password)
+	if err != nil || matchErr != nil || !valid {
+		authLogins.WithLabelValues("failure").Inc()
+		if err := app.loginFailed(ctx, requestPayload.Email); err != nil {
+			slog.WarnContext(ctx, "failed to record a failed login", "err", err)
+		}
+		app.errorJSON(w, errInvalidCredentials, http.StatusBadRequest)
+		return
+	}
+
+	// only now, so the answer doesn't tell who has an account. it isn't a
+	// failed login either, the password was right
+	if user.Disabled() {
+		authLogins.WithLabelValues("disabled").Inc()
+		app.errorJSON(w, errAccountDisabled, http.StatusForbidden)
 		return
 	}
 
+	// the password is only half of it, the user still has to send a code
+	// from their app to /authenticate/mfa. the failed logins aren't
+	// cleared until then, or guessing codes would never lock anybody out
+	if user.MFAEnabled() {
+		app.mfaChallenge(w, user)
+		return
+	}
+
+	if err := app.loginSucceeded(ctx, requestPayload.Email); err != nil {
+		slog.WarnContext(ctx, "failed to clear the failed logins", "err", err)
+	}
+	authLogins.WithLabelValues("success").Inc()
+	app.logIn(w, user, false)
+}
+
+// logIn gives user a new pair of tokens, the refresh token as a cookie too.
+// mfa is whether they logged in with a second factor
+func (app *application) logIn(w http.ResponseWriter, user *models.User, mfa bool) {
 	//create a jwt user
 	u := jwtUser{
-		ID:        user.ID,
-		FirstName: user.FirstName,
-		LastName:  user.LastName,
+		ID:            user.ID,
+		FirstName:     user.FirstName,
+		LastName:      user.LastName,
+		TokenVersion:  user.TokenVersion,
+		EmailVerified: user.EmailVerified(),
+		Role:          user.Role,
+		MFA:           mfa,
 	}
 
 	// generate tokens
@@ -97,6 +159,8 @@ func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	tokens.PasswordChangeRequired = user.PasswordChangeRequired
+
 	// log.Println(tokens.Token)
 	refreshCookie := app.auth.GetRefreshCookie(tokens.RefreshToken)
 
@@ -105,7 +169,6 @@ func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
 
 	// w.Write([]byte(tokens.Token))
 	app.writeJSON(w, http.StatusAccepted, tokens)
-	fmt.Println("/authenticate got hit.")
 }
 
 func (app *application) refreshToken(w http.ResponseWriter, r *http.Request) {
@@ -129,7 +192,9 @@ func (app *application) refreshToken(w http.ResponseWriter, r *http.Request) {
 			})
 			// we have check this >err< , because if anything goes wrong with
 			// this token, for example, if it's expired, the the User is not authorized
-			if err != nil {
+			// access tokens and MFA challenge tokens have a type,
+			// refresh tokens don't. neither of them gets new tokens
+			if err != nil || claims.Type != "" {
 				app.errorJSON(w, errors.New("unathorized"), http.StatusUnauthorized)
 				return
 			}
@@ -149,16 +214,33 @@ func (app *application) refreshToken(w http.ResponseWriter, r *http.Request) {
 			// try to refresh this user and give that user a new tokens
 			// but before that make sure the user exits in the database
 
-			user, err := app.DB.GetUserByID(userID)
+			user, err := app.db(r).GetUserByID(userID)
 			if err != nil {
 				app.errorJSON(w, errors.New("unknown user"), http.StatusUnauthorized)
 				return
 			}
 
+			// an admin disabled the account
+			if user.Disabled() {
+				app.errorJSON(w, errAccountDisabled, http.StatusUnauthorized)
+				return
+			}
+
+			// the sessions of the user were revoked (the password was
+			// reset) after this token was issued
+			if claims.TokenVersion != user.TokenVersion {
+				app.errorJSON(w, errors.New("unathorized"), http.StatusUnauthorized)
+				return
+			}
+
 			u := jwtUser{
-				ID:        user.ID,
-				FirstName: user.FirstName,
-				LastName:  user.LastName,
+				ID:            user.ID,
+				FirstName:     user.FirstName,
+				LastName:      user.LastName,
+				TokenVersion:  user.TokenVersion,
+				EmailVerified: user.EmailVerified(),
+				Role:          user.Role,
+				MFA:           claims.MFA,
 			}
 
 			// Generate a new token pair
@@ -167,6 +249,7 @@ func (app *application) refreshToken(w http.ResponseWriter, r *http.Request) {
 				app.errorJSON(w, errors.New("error generating error"), http.StatusUnauthorized)
 				return
 			}
+			tokenPairs.PasswordChangeRequired = user.PasswordChangeRequired
 
 			//set the  refresh token cookie
 			http.SetCookie(w, app.auth.GetRefreshCookie(tokenPairs.RefreshToken))
@@ -188,13 +271,13 @@ func (app *application) logout(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) MovieCatalog(w http.ResponseWriter, r *http.Request) {
-	movies, err := app.DB.AllMovie()
+	movies, err := app.db(r).AllMovie()
 	if err != nil {
 		app.errorJSON(w, err) // badRequst
 		return
 	}
 
-	_ = app.writeJSON(w, http.StatusOK, movies)
+	_ = app.render(w, r, http.StatusOK, "movie", movies)
 }
 
 // path: /movie/1
@@ -203,17 +286,20 @@ func (app *application) GetMovie(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	movieID, err := strconv.Atoi(id)
 	if err != nil {
-		log.Println("id:", id)
 		app.errorJSON(w, err)
 		return
 	}
 
-	movie, err := app.DB.OneMovie(movieID)
+	movie, err := app.db(r).OneMovie(movieID)
 	if err != nil {
 		app.errorJSON(w, err)
+		return
 	}
 
-	_ = app.writeJSON(w, http.StatusOK, movie)
+	w.Header().Set("ETag", movieETag(movie))
+	setLastModified(w, movie.UpdateAt)
+
+	_ = app.render(w, r, http.StatusOK, "movie", movie)
 
 }
 
@@ -226,7 +312,7 @@ func (app *application) MovieForEdit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	movie, genres, err := app.DB.OneMovieForEdit(movieID)
+	movie, genres, err := app.db(r).OneMovieForEdit(movieID)
 	if err != nil {
 		app.errorJSON(w, err)
 		return
@@ -240,54 +326,71 @@ func (app *application) MovieForEdit(w http.ResponseWriter, r *http.Request) {
 		genres,
 	}
 
+	// the editor sends this ETag back in If-Match when saving
+	w.Header().Set("ETag", movieETag(movie))
+	setLastModified(w, movie.UpdateAt)
+	if notModified(w, r) {
+		writeNotModified(w)
+		return
+	}
+
 	_ = app.writeJSON(w, http.StatusOK, payload)
 
 }
 
 func (app *application) AllGenres(w http.ResponseWriter, r *http.Request) {
-	genres, err := app.DB.AllGenres()
+	genres, err := app.db(r).AllGenres()
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
-	_ = app.writeJSON(w, http.StatusOK, genres)
+	_ = app.render(w, r, http.StatusOK, "genre", genres)
 }
 
+// path: POST /admin/movies
 // receives JSON payload from the frontend and try to insert into the database
 // and also try to go to a remote third-party api and look for an image for
-// the movie
-func (app *application) InsertMovie(w http.ResponseWriter, r *http.Request) {
-	log.Println("Insert movie got hit!")
+// the movie. answers 201 Created with the new movie and where to find it
+func (app *application) CreateMovie(w http.ResponseWriter, r *http.Request) {
 	var movie models.Movie
 
 	err := app.readJSON(w, r, &movie)
 	if err != nil {
-		log.Println(err)
 		app.errorJSON(w, err)
 		return
 	}
-	// fmt.Printf("movie: %v\n", movie)
-	// fmt.Printf("movie genres: %v", movie.Genres)
-	// try to get an image
-	movie = app.getPoster(movie)
-	// I should have a new movie variable with a poster included
-	movie.CreatedAt = time.Now()
-	movie.UpdateAt = time.Now()
 
-	// now we've inserted a movie into the database with an image(if we could
-	// find one ) and get the id of the new movie in movies table
-	newID, err := app.DB.InsertMovie(movie)
+	if problems := validateMovie(&movie); len(problems) > 0 {
+		app.errorJSON(w, errors.New(strings.Join(problems, ", ")), http.StatusUnprocessableEntity)
+		return
+	}
+
+	created, err := app.createMovie(r, movie)
 	if err != nil {
-		log.Println("error inserting movie")
 		app.errorJSON(w, err)
 		return
 	}
 
-	// now handle genres
-	err = app.DB.UpdateMovieGenre(newID, movie.GenresArray)
+	w.Header().Set("Location", fmt.Sprintf("/%s/admin/movies/%d", apiVersionFromContext(r.Context()), created.ID))
+	w.Header().Set("ETag", movieETag(created))
+	_ = app.writeJSON(w, http.StatusCreated, created)
+}
+
+// path: PUT /admin/movies/0
+// the old way of creating a movie, kept so existing clients keep working.
+// new clients should use POST /admin/movies
+func (app *application) InsertMovie(w http.ResponseWriter, r *http.Request) {
+	var movie models.Movie
+
+	err := app.readJSON(w, r, &movie)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	_, err = app.createMovie(r, movie)
 	if err != nil {
-		log.Println("error updating movie genres", err)
 		app.errorJSON(w, err)
 		return
 	}
@@ -299,8 +402,46 @@ func (app *application) InsertMovie(w http.ResponseWriter, r *http.Request) {
 	app.writeJSON(w, http.StatusAccepted, resp)
 }
 
+// createMovie does the work for both ways of creating a movie and gives
+// back the new movie with its id and genres
+func (app *application) createMovie(r *http.Request, movie models.Movie) (*models.Movie, error) {
+	// try to get an image
+	movie = app.getPoster(r.Context(), movie)
+	// I should have a new movie variable with a poster included
+	movie.CreatedAt = time.Now()
+	movie.UpdateAt = time.Now()
+
+	// now we've inserted a movie into the database with an image(if we could
+	// find one ) and get the id of the new movie in movies table
+	newID, err := app.db(r).InsertMovie(movie)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to insert movie", "err", err)
+		return nil, err
+	}
+
+	// now handle genres
+	err = app.db(r).UpdateMovieGenre(newID, movie.GenresArray)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to update movie genres", "movie_id", newID, "err", err)
+		return nil, err
+	}
+
+	created, err := app.db(r).OneMovie(newID)
+	if err != nil {
+		return nil, err
+	}
+
+	// write it down in the audit trail
+	after, err := app.movieSnapshot(r, newID)
+	if err == nil {
+		app.recordAudit(r, models.AuditCreate, newID, nil, after)
+	}
+
+	return created, nil
+}
+
 // we're getting the movie poster
-func (app *application) getPoster(movie models.Movie) models.Movie {
+func (app *application) getPoster(ctx context.Context, movie models.Movie) models.Movie {
 	// must match the structure of JSON , receiving from remote source
 	type TheMovieDB struct {
 		Page    int `json:"page"`
@@ -310,12 +451,17 @@ func (app *application) getPoster(movie models.Movie) models.Movie {
 		TotalPages int `json:"total_pages"`
 	}
 
-	client := &http.Client{}
+	// without a key TMDB won't talk to us, the movie just has no poster
+	if app.APIKey == "" {
+		return movie
+	}
+
+	// the transport passes our trace on to TMDB and times the call
+	client := &http.Client{Transport: tracedTransport{}}
 	theUrl := fmt.Sprintf("https://api.themoviedb.org/3/search/movie/?api_key=%s", app.APIKey)
-	log.Println(theUrl)
-	req, err := http.NewRequest("GET", theUrl+"&query="+url.QueryEscape(movie.Title), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", theUrl+"&query="+url.QueryEscape(movie.Title), nil)
 	if err != nil {
-		log.Println(err)
+		slog.ErrorContext(ctx, "poster lookup failed", "err", err)
 		return movie
 	}
 
@@ -323,9 +469,13 @@ func (app *application) getPoster(movie models.Movie) models.Movie {
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Content-Type", "application/json") // go practice to specify
 
+	start := time.Now()
 	resp, err := client.Do(req)
+	tmdbRequestDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
-		log.Println(err)
+		tmdbRequests.WithLabelValues(tmdbError).Inc()
+		// the error quotes the URL, the logger takes the api key out
+		slog.WarnContext(ctx, "poster lookup failed", "err", err)
 		return movie
 	}
 	defer resp.Body.Close() // to avoid resource leak
@@ -333,73 +483,107 @@ func (app *application) getPoster(movie models.Movie) models.Movie {
 	// read the body of the request(we are getting our response in the form
 	// of bytes)
 	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Println(err)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		tmdbRequests.WithLabelValues(tmdbError).Inc()
+		slog.WarnContext(ctx, "poster lookup failed", "status", resp.StatusCode, "err", err)
 		return movie
 	}
 
 	// unmarshal the request body and put it into responseObject
 	var responseObject TheMovieDB
 
-	json.Unmarshal(bodyBytes, &responseObject)
+	if err := json.Unmarshal(bodyBytes, &responseObject); err != nil {
+		tmdbRequests.WithLabelValues(tmdbError).Inc()
+		slog.WarnContext(ctx, "poster lookup returned something we can't read", "err", err)
+		return movie
+	}
 
 	if len(responseObject.Results) > 0 {
 		// I have atleast one movie in the response
 		movie.Image = responseObject.Results[0].PosterPath
+		tmdbRequests.WithLabelValues(tmdbFound).Inc()
+	} else {
+		tmdbRequests.WithLabelValues(tmdbNotFound).Inc()
 	}
 	return movie
 }
 
 // update a movie
+// PATCH /admin/movies/{id} only changes what the body mentions. the body is
+// a JSON merge patch (RFC 7396, plain JSON is treated the same way) or a
+// JSON patch (RFC 6902) when sent as application/json-patch+json.
+// the id in the URL decides which movie we change
 func (app *application) UpdateMovie(w http.ResponseWriter, r *http.Request) {
-	// this is going to receive a paylaod.
-	// and the payload describe the movie
-	var payload models.Movie
-
-	log.Println("UpdateMovie got hit!")
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
 
-	err := app.readJSON(w, r, &payload)
+	// get the existing record (movie) from the database, with its genres
+	// (this is also how it looked before we change it)
+	before, err := app.movieSnapshot(r, id)
 	if err != nil {
-		log.Println("failed to read json ", err)
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errors.New("movie not found"), http.StatusNotFound)
+			return
+		}
 		app.errorJSON(w, err)
 		return
 	}
-	// if we reach to this point, we have the payload
 
-	// get the existing record (movie) from the database
-	movie, err := app.DB.OneMovie(payload.ID)
+	// make sure nobody changed it since the editor loaded it
+	if !app.checkIfMatch(w, r, before) {
+		return
+	}
+
+	// same 1MB limit readJSON has
+	r.Body = http.MaxBytesReader(w, r.Body, 1024*1024)
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Println("failed to get the movie from database ", err)
 		app.errorJSON(w, err)
 		return
 	}
 
-	movie.Title = payload.Title
-	movie.ReleaseDate = payload.ReleaseDate
-	movie.Description = payload.Description
-	movie.MPAARating = payload.MPAARating
-	movie.RunTime = payload.RunTime
+	movie, err := patchMovie(before, r.Header.Get("Content-Type"), body)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
 	movie.UpdateAt = time.Now()
 
-	err = app.DB.UpdateMovie(*movie)
+	err = app.db(r).UpdateMovie(*movie, before.UpdateAt)
+	if errors.Is(err, repository.ErrMovieChanged) {
+		app.errorJSON(w, err, http.StatusPreconditionFailed)
+		return
+	}
 	if err != nil {
-		log.Println("failed to update a movie ", err)
+		slog.ErrorContext(r.Context(), "failed to update movie", "movie_id", movie.ID, "err", err)
 		app.errorJSON(w, err)
 		return
 	}
 
 	// handle the genres
-	err = app.DB.UpdateMovieGenre(movie.ID, payload.GenresArray)
+	err = app.db(r).UpdateMovieGenre(movie.ID, movie.GenresArray)
 	if err != nil {
-		log.Println("failed to update movie genres ", err)
+		slog.ErrorContext(r.Context(), "failed to update movie genres", "movie_id", movie.ID, "err", err)
 		app.errorJSON(w, err)
 		return
 	}
 
-	// response
+	after, err := app.movieSnapshot(r, movie.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	app.recordAudit(r, models.AuditUpdate, movie.ID, before, after)
+
+	// response, with the new ETag so the editor can keep editing
+	w.Header().Set("ETag", movieETag(after))
 	resp := JSONResponse{
 		Error:   false,
 		Message: "movie updated",
+		Data:    after,
 	}
 
 	app.writeJSON(w, http.StatusAccepted, resp)
@@ -413,84 +597,547 @@ func (app *application) DeleteMovie(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.DB.DeleteMovie(id)
+	// keep a copy of the movie in the audit trail
+	before, err := app.movieSnapshot(r, id)
+	if err != nil {
+		// not there, or already in the trash
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errors.New("movie not found"), http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, err)
+		return
+	}
+
+	// make sure the editor is deleting the version they think they are
+	if !app.checkIfMatch(w, r, before) {
+		return
+	}
+
+	err = app.db(r).DeleteMovie(id, before.UpdateAt)
+	if errors.Is(err, repository.ErrMovieChanged) {
+		app.errorJSON(w, err, http.StatusPreconditionFailed)
+		return
+	}
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
+	app.recordAudit(r, models.AuditDelete, id, before, nil)
+
 	// response
 	resp := JSONResponse{
 		Error:   false,
-		Message: "movie deleted",
+		Message: "movie moved to trash",
+	}
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// path: /admin/movies/{id}/history
+// every change that was made to a movie, newest first
+func (app *application) MovieHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	history, err := app.db(r).MovieHistory(id)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, history)
+}
+
+// path: /admin/movies/{id}/history/{revision}/restore
+// puts the movie back the way it was right after the given revision.
+// restoring a delete brings the movie back as it was before it was deleted
+func (app *application) RestoreMovieRevision(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	revisionID, err := strconv.Atoi(chi.URLParam(r, "revision"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	entry, err := app.db(r).GetAuditEntry(revisionID)
+	if err != nil || entry.MovieID != id {
+		app.errorJSON(w, errors.New("revision not found"), http.StatusNotFound)
+		return
+	}
+
+	state := entry.After
+	if len(state) == 0 {
+		state = entry.Before
+	}
+	// a purge keeps neither, the movie is gone for good
+	if len(state) == 0 {
+		app.errorJSON(w, errors.New("this revision has nothing to restore"), http.StatusConflict)
+		return
+	}
+	var movie models.Movie
+	err = json.Unmarshal(state, &movie)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	movie.ID = id
+	movie.UpdateAt = time.Now()
+
+	// the movie may have been deleted since, then we take it out of the
+	// trash, or if it's been purged already we put it back entirely
+	before, err := app.movieSnapshot(r, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		before = nil
+		err = app.db(r).RestoreFromTrash(id)
+		if errors.Is(err, sql.ErrNoRows) {
+			movie.CreatedAt = time.Now()
+			err = app.db(r).RestoreMovie(movie)
+		} else if err == nil {
+			err = app.db(r).UpdateMovie(movie, time.Time{})
+		}
+	} else if err == nil {
+		err = app.db(r).UpdateMovie(movie, time.Time{})
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.db(r).UpdateMovieGenre(id, movie.GenresArray)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	after, err := app.movieSnapshot(r, id)
+	if err == nil {
+		app.recordAudit(r, models.AuditRestore, id, before, after)
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "movie restored",
+		Data:    after,
+	}
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// path: /admin/movies/bulk
+// creates or updates many movies at once from a CSV or NDJSON file.
+// ?dry_run=true checks everything and reports what would happen without
+// saving anything, ?atomic=false saves the good rows even if some fail
+func (app *application) BulkImportMovies(w http.ResponseWriter, r *http.Request) {
+	report := models.ImportReport{
+		DryRun: r.URL.Query().Get("dry_run") == "true",
+		Atomic: r.URL.Query().Get("atomic") != "false",
+	}
+
+	// uploading a big file takes longer than the server's read timeout
+	// allows for other requests
+	extendDeadlines(w, repository.ImportTimeout, repository.ImportTimeout)
+
+	lines, err := app.readImportFile(w, r)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	if len(lines) == 0 {
+		app.errorJSON(w, errors.New("there are no movies in the file"))
+		return
+	}
+
+	// editors write genre names, we need ids
+	allGenres, err := app.db(r).AllGenres()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	genres := make(map[string]int)
+	for _, g := range allGenres {
+		genres[strings.ToLower(g.Genre)] = g.ID
+	}
+
+	// check every row first, only the good ones go to the database
+	var rows []models.MovieImportRow
+	seen := make(map[string]int)
+	for _, line := range lines {
+		if line.Err != nil {
+			report.Rows = append(report.Rows, models.ImportResult{Line: line.Line, Status: models.ImportFailed, Errors: []string{line.Err.Error()}})
+			continue
+		}
+
+		row, problems := validateImportRecord(line, genres)
+		if len(problems) == 0 {
+			key := importKey(row)
+			if first, ok := seen[key]; ok {
+				problems = append(problems, fmt.Sprintf("same movie as line %d", first))
+			} else {
+				seen[key] = row.Line
+			}
+		}
+		if len(problems) > 0 {
+			report.Rows = append(report.Rows, models.ImportResult{Line: row.Line, Title: row.Title, Status: models.ImportFailed, Errors: problems})
+			continue
+		}
+		rows = append(rows, row)
+	}
+
+	invalid := len(report.Rows) > 0
+	commit := !report.DryRun && !(report.Atomic && invalid)
+
+	if len(rows) > 0 {
+		// the database gets all of its time however long the upload took,
+		// and we get a few seconds more to write the report
+		extendDeadlines(w, 0, repository.ImportTimeout+5*time.Second)
+		results, committed, err := app.db(r).ImportMovies(rows, commit, report.Atomic)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+		report.Committed = committed
+		report.Rows = append(report.Rows, results...)
+	}
+	sort.Slice(report.Rows, func(i, j int) bool { return report.Rows[i].Line < report.Rows[j].Line })
+
+	for _, result := range report.Rows {
+		switch result.Status {
+		case models.ImportCreated:
+			report.Created++
+		case models.ImportUpdated:
+			report.Updated++
+		case models.ImportFailed:
+			report.Failed++
+		}
+
+		if report.Committed && result.Status != models.ImportFailed {
+			after, err := app.movieSnapshot(r, result.MovieID)
+			if err == nil {
+				app.recordAudit(r, models.AuditImport, result.MovieID, result.Before, after)
+			}
+		}
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "import finished",
+		Data:    report,
+	}
+	status := http.StatusOK
+	switch {
+	case report.DryRun:
+		resp.Message = "dry run, nothing was saved"
+	case !report.Committed:
+		resp.Error = true
+		resp.Message = "import failed, nothing was saved"
+		status = http.StatusUnprocessableEntity
+	case report.Failed > 0:
+		resp.Message = "import finished with errors"
+	}
+
+	_ = app.writeJSON(w, status, resp)
+}
+
+// path: /admin/export?format=csv|ndjson|json
+// streams the whole catalog (or the part that matches the filters) to the
+// client straight from the database, without holding it all in memory
+func (app *application) ExportMovies(w http.ResponseWriter, r *http.Request) {
+	filter, err := exportFilter(r)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	rd, err := exportRenderer(r.URL.Query().Get("format"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	extendDeadlines(w, 0, exportWriteTimeout)
+
+	filename := fmt.Sprintf("movies-%s.%s", time.Now().UTC().Format("20060102-150405"), rd.Extension())
+	w.Header().Set("Content-Type", rd.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	count := 0
+
+	out := rd.NewEncoder(w, "movie", true, movieCSVType)
+	err = app.db(r).ExportMovies(filter, func(movie *models.Movie) error {
+		if err := out.Encode(newExportRecord(movie)); err != nil {
+			return err
+		}
+		count++
+		if flusher != nil && count%exportFlushEvery == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		// we've already sent the status and part of the file, all we can
+		// do is stop, the client will see a truncated download
+		slog.ErrorContext(r.Context(), "export failed", "exported", count, "err", err)
+	}
+}
+
+// path: /admin/trash
+// the movies that were deleted but not purged yet
+func (app *application) Trash(w http.ResponseWriter, r *http.Request) {
+	movies, err := app.db(r).TrashedMovies()
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, movies)
+}
+
+// path: /admin/trash/{id}/restore
+func (app *application) RestoreFromTrash(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.db(r).RestoreFromTrash(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errors.New("movie is not in the trash"), http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, err)
+		return
+	}
+
+	after, err := app.movieSnapshot(r, id)
+	if err == nil {
+		app.recordAudit(r, models.AuditRestore, id, nil, after)
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "movie restored",
+	}
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// path: /admin/trash/{id}
+// deletes a movie that's in the trash for good, there's no undo for this
+// (other than restoring a revision from the history)
+func (app *application) PurgeMovie(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.db(r).PurgeMovie(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errors.New("movie is not in the trash"), http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.recordAudit(r, models.AuditPurge, id, nil, nil)
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "movie purged",
 	}
 	app.writeJSON(w, http.StatusAccepted, resp)
 }
 
 // return a list of movies for a particular genre
 func (app *application) AllMoviesByGenre(w http.ResponseWriter, r *http.Request) {
-	log.Println("AllMoviesByGenre got hit")
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
-	log.Println("id:", id)
 	if err != nil {
-		log.Println("id not found in the url")
 		app.errorJSON(w, err)
 		return
 	}
 
-	movies, err := app.DB.AllMovie(id)
+	movies, err := app.db(r).AllMovie(id)
 	if err != nil {
-		log.Println("failed to get all movies by genre id")
+		slog.ErrorContext(r.Context(), "failed to get movies by genre", "genre_id", id, "err", err)
 		app.errorJSON(w, err)
 		return
 	}
 	if len(movies) > 0 {
-		app.writeJSON(w, http.StatusOK, movies)
+		app.render(w, r, http.StatusOK, "movie", movies)
 	} else {
-		log.Println("No movies found.")
 		resp := JSONResponse{
 			Error:   true,
 			Message: "No movie found by genre",
 		}
 		app.writeJSON(w, http.StatusOK, resp)
 	}
-
-	log.Println("response StatusOK")
 }
 
 func (app *application) moviesGraphQL(w http.ResponseWriter, r *http.Request) {
-	// we need to populate our Graph type with the movies
-	movies, _ := app.DB.AllMovie()
+	//Note: our request can be the raw GraphQL syntax in the body (that's
+	// what our own front end sends), or JSON / url parameters in the format
+	// Automatic Persisted Queries (APQ) clients use
+	req, err := app.readGraphQLRequest(w, r)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
 
-	//Note: our request is not going to be in the form of JSON, instead will
-	// be in the form of the syntax used by GraphQL, but it's still
-	// going to be in the body of the request
+	// in allow-list mode only clients with a valid access token can send us
+	// queries we haven't approved in advance
+	_, _, authErr := app.auth.GetTokenFromHeaderAndVerify(w, r)
+	trusted := app.GraphQLMode != graphQLModeAllowList || authErr == nil
 
-	// get the query from the request
-	q, _ := io.ReadAll(r.Body) //  []byte
-	query := string(q)         // now I have query (q) as string
+	if pq := req.Extensions.PersistedQuery; pq != nil {
+		if pq.Version != 1 {
+			app.graphQLErrorJSON(w, http.StatusBadRequest, "PersistedQueryNotSupported", "PERSISTED_QUERY_NOT_SUPPORTED")
+			return
+		}
+
+		if req.Query == "" {
+			// the client only sent the hash, see if we know the query
+			query, ok := app.persistedQueries.Lookup(pq.SHA256Hash)
+			if !ok || (!trusted && !app.persistedQueries.Allowed(pq.SHA256Hash)) {
+				// this is the answer APQ clients wait for, they'll send
+				// the hash again along with the full query
+				app.graphQLErrorJSON(w, http.StatusOK, "PersistedQueryNotFound", "PERSISTED_QUERY_NOT_FOUND")
+				return
+			}
+			req.Query = query
+		} else {
+			if graph.HashQuery(req.Query) != strings.ToLower(pq.SHA256Hash) {
+				app.graphQLErrorJSON(w, http.StatusBadRequest, "provided sha does not match query", "BAD_REQUEST")
+				return
+			}
+			if !trusted && !app.persistedQueries.Allowed(pq.SHA256Hash) {
+				app.graphQLErrorJSON(w, http.StatusForbidden, "query is not allowed", "PERSISTED_QUERY_NOT_ALLOWED")
+				return
+			}
+			// remember it so next time the hash is enough
+			err = app.persistedQueries.Register(pq.SHA256Hash, req.Query)
+			if err != nil {
+				app.graphQLErrorJSON(w, http.StatusBadRequest, err.Error(), "BAD_REQUEST")
+				return
+			}
+		}
+	} else if !trusted && !app.persistedQueries.Allowed(graph.HashQuery(req.Query)) {
+		app.graphQLErrorJSON(w, http.StatusForbidden, "query is not allowed", "PERSISTED_QUERY_NOT_ALLOWED")
+		return
+	}
+
+	if req.Query == "" {
+		app.errorJSON(w, errors.New("no query"))
+		return
+	}
 
-	log.Println(query)
+	slog.DebugContext(r.Context(), "graphql query", "operation", req.OperationName, "query", req.Query)
 
 	// create a new variable of type *graph.Graph
-
-	g := graph.New(movies)
+	// the resolvers fetch only the page of movies they need from the database
+	g := graph.New(app.db(r))
+	g.Context = r.Context()
 
 	// set the query string on the variable
-	g.QueryString = query
+	g.QueryString = req.Query
+	g.Variables = req.Variables
+	g.OperationName = req.OperationName
 
 	// perform the query
 	resp, err := g.Query()
 	if err != nil {
-		log.Println("fail to perform the query ", err)
+		slog.ErrorContext(r.Context(), "graphql query failed", "operation", req.OperationName, "err", err)
 		app.errorJSON(w, err)
 		return
 	}
 
 	// send the response
 	json, _ := json.MarshalIndent(resp, "", "\t")
-	log.Println("response:", string(json))
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write(json)
 }
+
+// the shape of a GraphQL request sent as JSON, or as url parameters on a GET
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+	Extensions    struct {
+		PersistedQuery *struct {
+			Version    int    `json:"version"`
+			SHA256Hash string `json:"sha256Hash"`
+		} `json:"persistedQuery"`
+	} `json:"extensions"`
+}
+
+// readGraphQLRequest works out which of the three ways the query was sent
+func (app *application) readGraphQLRequest(w http.ResponseWriter, r *http.Request) (graphQLRequest, error) {
+	var req graphQLRequest
+
+	// GET /graph?query=...&variables=...&extensions=...
+	if r.Method == http.MethodGet {
+		qs := r.URL.Query()
+		req.Query = qs.Get("query")
+		req.OperationName = qs.Get("operationName")
+		if v := qs.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				return req, errors.New("variables must be a JSON object")
+			}
+		}
+		if e := qs.Get("extensions"); e != "" {
+			if err := json.Unmarshal([]byte(e), &req.Extensions); err != nil {
+				return req, errors.New("extensions must be a JSON object")
+			}
+		}
+		return req, nil
+	}
+
+	maxBytes := 1024 * 1024 // one megabyte, same as readJSON
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	// POST with a JSON body. we can't use readJSON here, APQ clients are
+	// allowed to send fields we don't know about
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		return req, err
+	}
+
+	// anything else is the raw query text
+	q, err := io.ReadAll(r.Body)
+	if err != nil {
+		return req, err
+	}
+	req.Query = string(q)
+	return req, nil
+}
+
+// graphQLErrorJSON writes an error the way GraphQL clients expect to find
+// it, in the errors list with a machine readable code
+func (app *application) graphQLErrorJSON(w http.ResponseWriter, status int, message, code string) {
+	type gqlError struct {
+		Message    string            `json:"message"`
+		Extensions map[string]string `json:"extensions"`
+	}
+	payload := struct {
+		Errors []gqlError `json:"errors"`
+	}{
+		Errors: []gqlError{{Message: message, Extensions: map[string]string{"code": code}}},
+	}
+
+	_ = app.writeJSON(w, status, payload)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// the states a check (and the whole service) can be in
+const (
+	healthOK          = "ok"
+	healthDegraded    = "degraded" // working, but something we'd like is missing
+	healthUnavailable = "unavailable"
+	healthSkipped     = "skipped"
+)
+
+// how long we trust the answer of the poster provider, so our
+// orchestrator probing every few seconds doesn't turn into traffic to TMDB
+const posterCheckTTL = 30 * time.Second
+
+const posterCheckURL = "https://api.themoviedb.org/3/configuration"
+
+type healthCheck struct {
+	Status   string      `json:"status"`
+	Duration string      `json:"duration,omitempty"`
+	Detail   interface{} `json:"detail,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status  string                 `json:"status"`
+	Version string                 `json:"version"`
+	Checks  map[string]healthCheck `json:"checks,omitempty"`
+}
+
+// Healthz tells the orchestrator the process is alive. it doesn't look at
+// anything else, a database outage is no reason to restart us
+func (app *application) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	_ = app.writeJSON(w, http.StatusOK, healthReport{Status: healthOK, Version: version})
+}
+
+// Readyz tells the orchestrator whether to send us traffic. we're ready
+// when the database answers, its schema is the one this build expects and
+// the background workers are running. the poster provider being down
+// only makes us degraded, we can still do everything but find posters
+func (app *application) Readyz(w http.ResponseWriter, r *http.Request) {
+	report := healthReport{
+		Status:  healthOK,
+		Version: version,
+		Checks: map[string]healthCheck{
+			"database":        app.checkDatabase(),
+			"migrations":      app.checkMigrations(),
+			"workers":         app.checkWorkers(),
+			"poster_provider": app.checkPosterProvider(),
+		},
+	}
+
+	if app.shuttingDown.Load() {
+		report.Checks["shutdown"] = healthCheck{Status: healthUnavailable, Error: "shutting down"}
+	}
+
+	for name, check := range report.Checks {
+		switch {
+		case check.Status == healthUnavailable && name != "poster_provider":
+			report.Status = healthUnavailable
+		case check.Status == healthUnavailable || check.Status == healthDegraded:
+			if report.Status == healthOK {
+				report.Status = healthDegraded
+			}
+		}
+	}
+
+	status := http.StatusOK
+	if report.Status == healthUnavailable {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	_ = app.writeJSON(w, status, report)
+}
+
+// timed runs a check and fills in how long it took
+func timed(check func() healthCheck) healthCheck {
+	start := time.Now()
+	result := check()
+	result.Duration = time.Since(start).Round(time.Microsecond).String()
+	return result
+}
+
+func (app *application) checkDatabase() healthCheck {
+	return timed(func() healthCheck {
+		if err := app.DB.Ping(); err != nil {
+			// the error can name the database host, that's for our logs
+			// and not for whoever asks /readyz
+			slog.Warn("readiness check: database unreachable", "err", err)
+			return healthCheck{Status: healthUnavailable, Error: "unavailable"}
+		}
+		stats := app.DB.Connection().Stats()
+		return healthCheck{Status: healthOK, Detail: map[string]int{
+			"open_connections": stats.OpenConnections,
+			"in_use":           stats.InUse,
+			"idle":             stats.Idle,
+		}}
+	})
+}
+
+func (app *application) checkMigrations() healthCheck {
+	return timed(func() healthCheck {
+		current, dirty, err := app.DB.SchemaVersion()
+		if err != nil {
+			slog.Warn("readiness check: failed to read the schema version", "err", err)
+			return healthCheck{Status: healthUnavailable, Error: "unavailable"}
+		}
+		detail := map[string]interface{}{"expected": schemaVersion, "current": current}
+		switch {
+		case dirty:
+			return healthCheck{Status: healthUnavailable, Detail: detail, Error: "the last migration failed half way"}
+		case current != schemaVersion:
+			return healthCheck{Status: healthUnavailable, Detail: detail, Error: "the database schema doesn't match this build"}
+		}
+		return healthCheck{Status: healthOK, Detail: detail}
+	})
+}
+
+func (app *application) checkWorkers() healthCheck {
+	statuses := app.workerStatuses()
+	check := healthCheck{Status: healthOK, Detail: statuses}
+	for name, status := range statuses {
+		if !status.Running {
+			check.Status = healthUnavailable
+			check.Error = fmt.Sprintf("%s is not running", name)
+		}
+	}
+	return check
+}
+
+// posterCheck remembers the last time we asked TMDB whether it's there
+type posterCheck struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	result    healthCheck
+}
+
+// checkPosterProvider sees whether we can reach TMDB. any answer at all
+// means it's reachable, we only care about the network here
+func (app *application) checkPosterProvider() healthCheck {
+	if app.APIKey == "" {
+		return healthCheck{Status: healthSkipped, Detail: "no api key configured"}
+	}
+
+	app.posterHealthy.mu.Lock()
+	defer app.posterHealthy.mu.Unlock()
+
+	if time.Since(app.posterHealthy.checkedAt) < posterCheckTTL {
+		return app.posterHealthy.result
+	}
+
+	app.posterHealthy.result = timed(func() healthCheck {
+		client := &http.Client{Timeout: 2 * time.Second}
+		resp, err := client.Get(posterCheckURL)
+		if err != nil {
+			return healthCheck{Status: healthDegraded, Error: "poster provider unreachable"}
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return healthCheck{Status: healthDegraded, Error: fmt.Sprintf("poster provider answered %d", resp.StatusCode)}
+		}
+		return healthCheck{Status: healthOK}
+	})
+	app.posterHealthy.checkedAt = time.Now()
+	return app.posterHealthy.result
+}
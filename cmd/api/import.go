@@ -0,0 +1,260 @@
+package main
+
+import (
+	"backend/internals/models"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// an import file can be a lot bigger than the 1MB readJSON allows
+const maxImportBytes = 10 * 1024 * 1024
+
+// the ratings our front end lets editors pick from
+var mpaaRatings = map[string]bool{
+	"G":    true,
+	"PG":   true,
+	"PG13": true,
+	"R":    true,
+	"NC17": true,
+	"18A":  true,
+}
+
+// importRecord is one row of an import file before we've checked it.
+// NDJSON lines are decoded straight into it, CSV columns are matched
+// to the json names
+type importRecord struct {
+	ExternalID  string          `json:"external_id"`
+	Title       string          `json:"title"`
+	ReleaseDate string          `json:"release_date"`
+	RunTime     json.RawMessage `json:"runtime"`
+	MPAARating  string          `json:"mpaa_rating"`
+	Description string          `json:"description"`
+	Genres      []string        `json:"genres"`
+}
+
+// importLine is a record along with where it came from, or why we
+// couldn't read it
+type importLine struct {
+	Line   int
+	Record importRecord
+	Err    error
+}
+
+// readImportFile works out what format the upload is in and reads every
+// line of it. the file can be the request body (Content-Type text/csv or
+// application/x-ndjson) or a "file" field of a multipart form
+func (app *application) readImportFile(w http.ResponseWriter, r *http.Request) ([]importLine, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+
+	format := r.URL.Query().Get("format")
+	var body io.Reader = r.Body
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			return nil, errors.New("the upload must have a \"file\" field")
+		}
+		defer file.Close()
+		body = file
+
+		if format == "" {
+			switch strings.ToLower(filepath.Ext(header.Filename)) {
+			case ".csv":
+				format = "csv"
+			case ".ndjson", ".jsonl":
+				format = "ndjson"
+			}
+		}
+	} else if format == "" {
+		switch mediaType {
+		case "text/csv":
+			format = "csv"
+		case "application/x-ndjson", "application/jsonl", "application/json":
+			format = "ndjson"
+		}
+	}
+
+	switch format {
+	case "csv":
+		return readImportCSV(body)
+	case "ndjson":
+		return readImportNDJSON(body)
+	default:
+		return nil, errors.New("unknown import format, send text/csv or application/x-ndjson")
+	}
+}
+
+// readImportCSV reads a CSV file with a header row. the columns can be in
+// any order, genres are genre names separated by "|"
+func readImportCSV(body io.Reader) ([]importLine, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading csv header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["title"]; !ok {
+		return nil, errors.New("the csv header must have a title column")
+	}
+
+	var lines []importLine
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		// a row with the wrong number of columns is that row's problem,
+		// anything else means we can't trust the rest of the file
+		if err != nil && !errors.Is(err, csv.ErrFieldCount) {
+			return nil, fmt.Errorf("reading csv: %w", err)
+		}
+		if err != nil {
+			// the reader only knows where the fields of a row are when it
+			// could split it, the error knows where the row starts
+			line := 0
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				line = parseErr.StartLine
+			}
+			lines = append(lines, importLine{Line: line, Err: errors.New("wrong number of columns")})
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+
+		get := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(fields) {
+				return strings.TrimSpace(fields[i])
+			}
+			return ""
+		}
+
+		rec := importRecord{
+			ExternalID:  get("external_id"),
+			Title:       get("title"),
+			ReleaseDate: get("release_date"),
+			MPAARating:  get("mpaa_rating"),
+			Description: get("description"),
+			Genres:      strings.Split(get("genres"), "|"),
+		}
+		if runtime := get("runtime"); runtime != "" {
+			rec.RunTime = json.RawMessage(runtime)
+		}
+
+		lines = append(lines, importLine{Line: line, Record: rec})
+	}
+
+	return lines, nil
+}
+
+// readImportNDJSON reads one JSON object per line
+func readImportNDJSON(body io.Reader) ([]importLine, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxImportBytes)
+
+	var lines []importLine
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		// unknown fields are fine, that way a file from /admin/export
+		// (which has ids and timestamps) can be imported again
+		var rec importRecord
+		if err := json.Unmarshal([]byte(text), &rec); err != nil {
+			lines = append(lines, importLine{Line: line, Err: fmt.Errorf("invalid JSON: %w", err)})
+			continue
+		}
+		lines = append(lines, importLine{Line: line, Record: rec})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading ndjson: %w", err)
+	}
+
+	return lines, nil
+}
+
+// validateImportRecord checks every field of a record and collects all the
+// problems with it, not just the first one, so the editor can fix the row
+// in one go. genres maps lower case genre names to their ids
+func validateImportRecord(line importLine, genres map[string]int) (models.MovieImportRow, []string) {
+	rec := line.Record
+	row := models.MovieImportRow{
+		Line:        line.Line,
+		ExternalID:  rec.ExternalID,
+		Title:       strings.TrimSpace(rec.Title),
+		MPAARating:  strings.ToUpper(strings.TrimSpace(rec.MPAARating)),
+		Description: strings.TrimSpace(rec.Description),
+	}
+
+	var problems []string
+	if row.Title == "" {
+		problems = append(problems, "title is required")
+	} else if len(row.Title) > 512 {
+		problems = append(problems, "title is longer than 512 characters")
+	}
+
+	releaseDate, err := time.Parse("2006-01-02", strings.TrimSpace(rec.ReleaseDate))
+	if err != nil {
+		problems = append(problems, "release_date must be a date like 2006-01-02")
+	}
+	row.ReleaseDate = releaseDate
+
+	runtime, err := strconv.Atoi(strings.Trim(string(rec.RunTime), `" `))
+	if err != nil || runtime <= 0 {
+		problems = append(problems, "runtime must be a whole number of minutes")
+	}
+	row.RunTime = runtime
+
+	if !mpaaRatings[row.MPAARating] {
+		problems = append(problems, fmt.Sprintf("mpaa_rating %q is not a rating we know", rec.MPAARating))
+	}
+	if row.Description == "" {
+		problems = append(problems, "description is required")
+	}
+
+	for _, name := range rec.Genres {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := genres[strings.ToLower(name)]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown genre %q", name))
+			continue
+		}
+		row.GenreIDs = append(row.GenreIDs, id)
+	}
+	if len(row.GenreIDs) == 0 && len(problems) == 0 {
+		problems = append(problems, "at least one genre is required")
+	}
+
+	return row, problems
+}
+
+// importKey is how we spot the same movie twice in one file, the same way
+// the database matches them
+func importKey(row models.MovieImportRow) string {
+	if row.ExternalID != "" {
+		return "id:" + row.ExternalID
+	}
+	return fmt.Sprintf("title:%s:%d", strings.ToLower(row.Title), row.ReleaseDate.Year())
+}
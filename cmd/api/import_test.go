@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadImportCSV(t *testing.T) {
+	lines, err := readImportCSV(strings.NewReader("title,runtime\nAlien,117\nHeat\n\nJaws,124\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3", len(lines))
+	}
+	if lines[0].Line != 2 || lines[0].Err != nil || lines[0].Record.Title != "Alien" {
+		t.Errorf("first row: %+v", lines[0])
+	}
+	if lines[1].Line != 3 || lines[1].Err == nil {
+		t.Errorf("short row: %+v", lines[1])
+	}
+	if lines[2].Line != 5 || lines[2].Err != nil || lines[2].Record.Title != "Jaws" {
+		t.Errorf("last row: %+v", lines[2])
+	}
+}
+
+// a row the reader can't split has no field positions, asking for them
+// used to panic
+func TestReadImportCSVMalformedFirstField(t *testing.T) {
+	for _, body := range []string{
+		"title,runtime\n\",117\n",
+		"title,runtime\nAlien,117\na\"b,124\n",
+	} {
+		_, err := readImportCSV(strings.NewReader(body))
+		if err == nil || !strings.Contains(err.Error(), "line") {
+			t.Errorf("%q: got %v, want an error saying which line", body, err)
+		}
+	}
+}
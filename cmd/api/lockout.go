@@ -0,0 +1,139 @@
+package main
+
+import (
+	"backend/internals/models"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// dummyPasswordHash is checked against the password when nobody has the
+// email address, so a login for an unknown address takes as long as one
+// with a wrong password. it has the cost of our real hashes (14), and
+// nobody knows the password it's the hash of
+const dummyPasswordHash = "$2a$14$HJkt1.WWRBz2soVZbjoPAu8q9N62mJ3LRsoP0tEdxkVopnJY9kjCq"
+
+var (
+	errLockedOut          = errors.New("too many failed logins, try again later")
+	errInvalidCredentials = errors.New("invalid credentials")
+)
+
+// lockoutPolicy is how we slow down somebody guessing the password of an
+// account: after Threshold failed logins in a row the account is locked
+// for Duration, and every failure after that doubles it, up to Max.
+// failures more than Window apart (or Window after a lock ran out) don't
+// add up
+type lockoutPolicy struct {
+	Threshold int
+	Duration  time.Duration
+	Max       time.Duration
+	Window    time.Duration
+}
+
+func (p lockoutPolicy) enabled() bool {
+	return p.Threshold > 0 && p.Duration > 0
+}
+
+// fail records a failed login
+func (p lockoutPolicy) fail(failures *models.LoginFailures, now time.Time) {
+	// the window starts again when a lock runs out, so the next failure
+	// after a long lock still makes the lock after it longer
+	since := failures.LastFailureAt
+	if failures.LockedUntil.After(since) {
+		since = failures.LockedUntil
+	}
+	if now.Sub(since) > p.Window {
+		failures.Failures = 0
+	}
+	failures.Failures++
+	failures.LastFailureAt = now
+
+	if failures.Failures < p.Threshold {
+		return
+	}
+	lock := p.Max
+	// past 30 doublings we're way over any sensible Max anyway
+	if n := failures.Failures - p.Threshold; n < 30 {
+		if d := p.Duration << n; d < p.Max {
+			lock = d
+		}
+	}
+	failures.LockedUntil = now.Add(lock)
+}
+
+// loginKey is the key we count the failed logins of an email address
+// under. the same address in other case is the same account
+func loginKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// lockedOut tells how long logging in as email is still locked for, zero
+// when it isn't
+func (app *application) lockedOut(ctx context.Context, email string) (time.Duration, error) {
+	if !app.lockout.enabled() {
+		return 0, nil
+	}
+	failures, err := app.rateLimits.LoginFailures(ctx, loginKey(email))
+	if err != nil {
+		return 0, err
+	}
+	return time.Until(failures.LockedUntil), nil
+}
+
+// loginFailed counts a failed login for email, whether or not anybody
+// has that address
+func (app *application) loginFailed(ctx context.Context, email string) error {
+	if !app.lockout.enabled() {
+		return nil
+	}
+	return app.rateLimits.UpdateLoginFailures(ctx, loginKey(email), func(failures *models.LoginFailures) error {
+		app.lockout.fail(failures, time.Now())
+		return nil
+	})
+}
+
+// confirmUser makes sure whoever is acting as user (to log in, or to
+// change something only the owner of the account should) is them, with
+// check. the failures count towards the lockout of the account like failed
+// logins, fail is what we answer them with. when check doesn't pass it
+// answers the request and tells false
+func (app *application) confirmUser(w http.ResponseWriter, r *http.Request, user *models.User, fail error, check func() (bool, error)) bool {
+	ctx := r.Context()
+	if wait, err := app.lockedOut(ctx, user.Email); err != nil {
+		slog.WarnContext(ctx, "failed to check the login lockout", "err", err)
+	} else if wait > 0 {
+		authLogins.WithLabelValues("locked").Inc()
+		app.tooManyRequests(w, errLockedOut, wait)
+		return false
+	}
+
+	ok, err := check()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		authLogins.WithLabelValues("failure").Inc()
+		if err := app.loginFailed(ctx, user.Email); err != nil {
+			slog.WarnContext(ctx, "failed to record a failed login", "err", err)
+		}
+		app.errorJSON(w, fail)
+		return false
+	}
+
+	if err := app.loginSucceeded(ctx, user.Email); err != nil {
+		slog.WarnContext(ctx, "failed to clear the failed logins", "err", err)
+	}
+	return true
+}
+
+// loginSucceeded forgets the failed logins of email
+func (app *application) loginSucceeded(ctx context.Context, email string) error {
+	if !app.lockout.enabled() {
+		return nil
+	}
+	return app.rateLimits.ClearLoginFailures(ctx, loginKey(email))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+
+	"backend/internals/logging"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// the header a request id comes in (from a proxy in front of us) and goes
+// back out in, so a client can quote it when something goes wrong
+const requestIDHeader = "X-Request-ID"
+
+// ids we accept from outside. anything else could be used to forge log
+// lines, so we make up our own id instead
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestID gives every request an id, puts it in the request context
+// (so everything logged while serving it, the repository included,
+// carries it) and sends it back in the X-Request-ID header
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// what the access log needs to know that only a handler further down
+// finds out, like who the user is. authRequired fills it in
+type requestLogInfo struct {
+	UserID string
+}
+
+type requestLogInfoKey struct{}
+
+// setRequestUser records who is making the request for the access log
+func setRequestUser(ctx context.Context, userID string) {
+	if info, ok := ctx.Value(requestLogInfoKey{}).(*requestLogInfo); ok {
+		info.UserID = userID
+	}
+}
+
+// accessLog writes one line for every request: what was asked for, the
+// route it matched, what we answered, how long it took and for whom
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestLogInfo{}
+		ctx := context.WithValue(r.Context(), requestLogInfoKey{}, info)
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		route := ""
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			route = rctx.RoutePattern()
+		}
+
+		level := slog.LevelInfo
+		if sw.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+
+		// the query string can hold tokens, it's redacted by the logger
+		slog.LogAttrs(ctx, level, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("query", r.URL.RawQuery),
+			slog.String("route", route),
+			slog.Int("status", sw.status),
+			slog.Int("bytes", sw.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("user_id", info.UserID),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.String("user_agent", r.UserAgent()),
+		)
+	})
+}
@@ -1,28 +1,137 @@
 package main
 
 import (
+	"backend/internals/graph"
+	"backend/internals/logging"
+	"backend/internals/mailer"
 	"backend/internals/repository"
 	"backend/internals/repository/dbrepo"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// these are filled in when we build a release, for example
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse --short HEAD)" ./cmd/api
+var (
+	version   = "dev"
+	commit    = ""
+	buildTime = ""
 )
 
-const port = 8080
+// how /graph treats query text it hasn't seen before
+const (
+	// anyone can send any query (and register it as a persisted query)
+	graphQLModeOpen = "open"
+	// clients without a valid access token can only run the queries
+	// in the persisted query manifest
+	graphQLModeAllowList = "allowlist"
+)
 
 type application struct {
-	DSN    string
-	Domain string
+	// dev, staging or production. only dev runs with the default secrets,
+	// and only when DevSecrets says so
+	Env        string
+	DevSecrets bool
+	Port       int
+	DSN        string
+	Domain     string
+
+	// the size of the database connection pool
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration
+	DBConnMaxIdleTime time.Duration
+	// bring the schema up to date before we start serving
+	Migrate bool
+
 	// DB     *sql.DB //=> is a pool of database connections
 	DB           repository.DatabaseRepo
 	auth         Auth
+	cors         CORS
 	JWTSecret    string
 	JWTIssuer    string
 	JWTAudience  string
 	CookieDomain string
 	APIKey       string
+
+	GraphQLMode      string
+	GraphQLManifest  string
+	persistedQueries *graph.PersistedQueries
+
+	// how long deleted movies stay in the trash before they're purged
+	TrashRetention time.Duration
+
+	// the timeouts of the web server, and how long we wait for requests
+	// and workers to finish when we shut down
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	ShutdownTimeout   time.Duration
+
+	// where our OpenTelemetry spans go (none|stdout|file) and how many
+	// of the traces that start here we keep
+	TraceExporter    string
+	TraceFile        string
+	TraceSampleRatio float64
+	shutdownTracing  func(context.Context) error
+
+	// how often a client can call us, and how we slow down somebody
+	// guessing passwords. the buckets and failed logins are kept in
+	// rateLimits (memory or postgres)
+	RateLimitStore    string
+	RateLimit         rateLimit
+	AuthRateLimit     rateLimit
+	TrustForwardedFor bool
+	lockout           lockoutPolicy
+	rateLimits        rateLimitStore
+
+	// how we reset forgotten passwords: the web site the reset links
+	// point to, how long they work, what a new password must look like
+	// and how we send the emails
+	FrontendURL         string
+	PasswordResetExpiry time.Duration
+	passwordPolicy      passwordPolicy
+	Mailer              string
+	MailFile            string
+	MailFrom            string
+	SMTPHost            string
+	SMTPPort            int
+	SMTPUsername        string
+	SMTPPassword        string
+	mailer              mailer.Mailer
+
+	// how long the links that verify an email address work, and how often
+	// a user can ask for another one
+	EmailVerifyExpiry time.Duration
+	VerifyResendLimit rateLimit
+
+	// two-factor authentication: the name authenticator apps show our
+	// codes under, and whether admins have to use it
+	MFAIssuer       string
+	RequireAdminMFA bool
+
+	// the background workers, so we can wait for them when we shut down
+	// and report on them in /readyz
+	workers       sync.WaitGroup
+	workersMu     sync.Mutex
+	workerStatus  map[string]*workerStatus
+	shuttingDown  atomic.Bool
+	posterHealthy posterCheck
 }
 
 func main() {
@@ -38,14 +147,153 @@ func main() {
 
 	// read from the command line
 	// flag package is part of the standard library
-	flag.StringVar(&app.DSN, "dsn", "host=localhost port=5432 user=postgres password=postgres dbname=movies sslmode=disable timezone=UTC connect_timeout=5", "Postgres connection string") // pgx connection string
-	flag.StringVar(&app.JWTSecret, "jwt-secret", "verysecret", "signing secret")
+	// (every flag can also be set from the environment or a config
+	// file, see config.go)
+	flag.StringVar(&app.Env, "env", envDevelopment, "environment (dev|staging|production)")
+	flag.BoolVar(&app.DevSecrets, "dev-secrets", false, "run with the built-in jwt-secret and dsn, which anybody can read in the source (env dev only)")
+	flag.IntVar(&app.Port, "port", 8080, "port to listen on")
+	flag.DurationVar(&app.ReadHeaderTimeout, "read-header-timeout", 5*time.Second, "how long a client has to send the request headers")
+	flag.DurationVar(&app.ReadTimeout, "read-timeout", 15*time.Second, "how long a client has to send the whole request")
+	flag.DurationVar(&app.WriteTimeout, "write-timeout", 30*time.Second, "how long we have to send the response")
+	flag.DurationVar(&app.IdleTimeout, "idle-timeout", 2*time.Minute, "how long a keep-alive connection can sit idle")
+	flag.DurationVar(&app.ShutdownTimeout, "shutdown-timeout", 20*time.Second, "how long to wait for requests and workers to finish when shutting down")
+	flag.StringVar(&app.DSN, "dsn", defaultDSN, "Postgres connection string") // pgx connection string
+	flag.IntVar(&app.DBMaxOpenConns, "db-max-open-conns", 25, "most database connections open at once (0 is no limit)")
+	flag.IntVar(&app.DBMaxIdleConns, "db-max-idle-conns", 25, "most idle database connections kept in the pool")
+	flag.DurationVar(&app.DBConnMaxLifetime, "db-conn-max-lifetime", time.Hour, "how long a database connection is reused")
+	flag.DurationVar(&app.DBConnMaxIdleTime, "db-conn-max-idle-time", 15*time.Minute, "how long a database connection can sit idle")
+	flag.BoolVar(&app.Migrate, "migrate", true, "apply the database migrations this build has and the database doesn't at startup")
+	flag.StringVar(&app.JWTSecret, "jwt-secret", defaultJWTSecret, "signing secret")
 	flag.StringVar(&app.JWTIssuer, "jwt-issuer", "example.com", "signing issuer")
 	flag.StringVar(&app.JWTAudience, "jwt-audience", "example.com", "signing audience")
-	flag.StringVar(&app.CookieDomain, "cookie-domain", "localhost", "cookie domain")
+	flag.DurationVar(&app.auth.TokenExpiry, "token-expiry", 15*time.Minute, "how long an access token is valid")
+	flag.DurationVar(&app.auth.RefreshExpiry, "refresh-expiry", 24*time.Hour, "how long a refresh token is valid")
+	flag.StringVar(&app.auth.CookieName, "cookie-name", "__Host-refresh_token", "name of the refresh token cookie")
+	flag.StringVar(&app.auth.CookiePath, "cookie-path", "/", "path of the refresh token cookie")
+	flag.StringVar(&app.CookieDomain, "cookie-domain", "", "domain of the refresh token cookie (must be empty for a __Host- cookie)")
+	flag.BoolVar(&app.auth.CookieSecure, "cookie-secure", true, "only send the refresh token cookie over HTTPS")
+	var cookieSameSite string
+	flag.StringVar(&cookieSameSite, "cookie-samesite", "strict", "SameSite of the refresh token cookie (strict|lax|none)")
 	flag.StringVar(&app.Domain, "domain", "example.com", " domain")
-	flag.StringVar(&app.APIKey, "api-key", "3859630f1b7f23836cf6030336669b4a", "api key")
-	flag.Parse() // parses everything that we read from the command line
+	flag.StringVar(&app.APIKey, "api-key", "", "TMDB api key, posters aren't looked up without one")
+	flag.StringVar(&app.GraphQLMode, "graphql-mode", graphQLModeOpen, "graphql query mode (open|allowlist)")
+	flag.StringVar(&app.GraphQLManifest, "graphql-manifest", "", "path to the persisted query manifest (JSON of hash => query)")
+	flag.DurationVar(&app.TrashRetention, "trash-retention", 30*24*time.Hour, "how long deleted movies are kept in the trash")
+	flag.StringVar(&app.RateLimitStore, "rate-limit-store", rateLimitStoreMemory, "where rate limits and failed logins are kept (memory|postgres)")
+	flag.IntVar(&app.RateLimit.Requests, "rate-limit-requests", 300, "requests a client can make to a route per rate-limit-period (0 is no limit)")
+	flag.DurationVar(&app.RateLimit.Period, "rate-limit-period", time.Minute, "how long it takes a client to get all its requests back")
+	flag.IntVar(&app.AuthRateLimit.Requests, "rate-limit-auth-requests", 10, "login attempts a client can make per rate-limit-auth-period (0 is no limit)")
+	flag.DurationVar(&app.AuthRateLimit.Period, "rate-limit-auth-period", time.Minute, "how long it takes a client to get all its login attempts back")
+	flag.BoolVar(&app.TrustForwardedFor, "trust-forwarded-for", false, "take the client address from X-Forwarded-For, only behind a proxy that sets it")
+	flag.IntVar(&app.lockout.Threshold, "login-lockout-threshold", 5, "failed logins in a row before an account is locked (0 is never)")
+	flag.DurationVar(&app.lockout.Duration, "login-lockout-duration", time.Minute, "how long an account is locked at first, doubled on every failure after that")
+	flag.DurationVar(&app.lockout.Max, "login-lockout-max", time.Hour, "the longest an account is locked")
+	flag.DurationVar(&app.lockout.Window, "login-failure-window", 15*time.Minute, "how long a failed login counts towards a lockout")
+	flag.StringVar(&app.FrontendURL, "frontend-url", "http://localhost:3000", "the web site the links in our emails point to")
+	flag.DurationVar(&app.PasswordResetExpiry, "password-reset-expiry", time.Hour, "how long a password reset link works")
+	flag.IntVar(&app.passwordPolicy.MinLength, "password-min-length", 12, "the fewest characters a new password can have")
+	flag.DurationVar(&app.EmailVerifyExpiry, "email-verify-expiry", 24*time.Hour, "how long an email verification link works")
+	flag.IntVar(&app.VerifyResendLimit.Requests, "verify-resend-requests", 3, "verification emails a user can ask for per verify-resend-period (0 is no limit)")
+	flag.DurationVar(&app.VerifyResendLimit.Period, "verify-resend-period", time.Hour, "how long it takes a user to get all their verification emails back")
+	flag.StringVar(&app.MFAIssuer, "mfa-issuer", "Movies", "the name authenticator apps show our codes under")
+	flag.BoolVar(&app.RequireAdminMFA, "require-admin-mfa", false, "admins can only use /admin after logging in with two-factor authentication")
+	flag.DurationVar(&app.auth.MFATokenExpiry, "mfa-token-expiry", 5*time.Minute, "how long a user has to type the code after the password")
+	flag.StringVar(&app.Mailer, "mailer", mailerLog, "how emails are sent (smtp|file|log)")
+	flag.StringVar(&app.MailFile, "mail-file", "mail.log", "the file the file mailer appends emails to")
+	flag.StringVar(&app.MailFrom, "mail-from", "Movies <no-reply@example.com>", "who our emails are from")
+	flag.StringVar(&app.SMTPHost, "smtp-host", "", "SMTP server to send emails through")
+	flag.IntVar(&app.SMTPPort, "smtp-port", 587, "port of the SMTP server")
+	flag.StringVar(&app.SMTPUsername, "smtp-username", "", "SMTP user name, empty to send without logging in")
+	flag.StringVar(&app.SMTPPassword, "smtp-password", "", "SMTP password")
+	flag.StringVar(&app.TraceExporter, "trace-exporter", traceExporterNone, "where traces are exported (none|stdout|file)")
+	flag.StringVar(&app.TraceFile, "trace-file", "traces.jsonl", "the file the file trace exporter appends OTLP/JSON to")
+	flag.Float64Var(&app.TraceSampleRatio, "trace-sample-ratio", 1, "share of the traces starting here that are recorded, 0 to 1")
+	var logFormat, logLevel string
+	flag.StringVar(&logFormat, "log-format", "text", "log output (text|json)")
+	flag.StringVar(&logLevel, "log-level", "info", "least important log level written (debug|info|warn|error)")
+	var corsOrigins, corsMethods, corsHeaders string
+	flag.StringVar(&corsOrigins, "cors-allowed-origins", "http://localhost:3000", "comma separated origins that can call the API from a browser, * works as a wildcard (https://*.example.com)")
+	flag.StringVar(&corsMethods, "cors-allowed-methods", "GET,POST,PUT,PATCH,DELETE,OPTIONS", "comma separated methods allowed in cross-origin requests")
+	flag.StringVar(&corsHeaders, "cors-allowed-headers", "Accept,Content-Type,X-CSRF-Token,Authorization,If-Match,If-None-Match,If-Modified-Since,Idempotency-Key,X-Request-ID,traceparent,tracestate", "comma separated request headers allowed in cross-origin requests")
+	flag.BoolVar(&app.cors.AllowCredentials, "cors-allow-credentials", true, "let browsers send cookies and the Authorization header cross-origin")
+	flag.DurationVar(&app.cors.MaxAge, "cors-max-age", 10*time.Minute, "how long browsers can cache a preflight response")
+	// parses everything that we read from the command line, then
+	// fills in the rest from the environment and the config file
+	if err := loadConfig(flag.CommandLine, os.Args[1:]); err != nil {
+		fatal("failed to load the configuration", err)
+	}
+
+	// structured logs from here on, everything that still uses the log
+	// package (like the Recoverer) ends up in here too
+	level, err := logging.ParseLevel(logLevel)
+	if err != nil {
+		fatal("unknown log-level", err)
+	}
+	if logFormat != "text" && logFormat != "json" {
+		fatal("unknown log-format", fmt.Errorf("%q", logFormat))
+	}
+	slog.SetDefault(logging.New(os.Stderr, logFormat, level))
+
+	app.auth.Issuer = app.JWTIssuer
+	app.auth.Audience = app.JWTAudience
+	app.auth.Secret = app.JWTSecret
+	app.auth.CookieDomain = app.CookieDomain
+	switch strings.ToLower(cookieSameSite) {
+	case "strict":
+		app.auth.CookieSameSite = http.SameSiteStrictMode
+	case "lax":
+		app.auth.CookieSameSite = http.SameSiteLaxMode
+	case "none":
+		app.auth.CookieSameSite = http.SameSiteNoneMode
+	default:
+		fatal("unknown cookie-samesite", fmt.Errorf("%q", cookieSameSite))
+	}
+
+	if err := app.validate(); err != nil {
+		fatal("refusing to start", err)
+	}
+
+	app.cors.AllowedOrigins = splitList(corsOrigins)
+	app.cors.AllowedMethods = splitList(corsMethods)
+	app.cors.AllowedHeaders = splitList(corsHeaders)
+	if err := app.cors.Validate(); err != nil {
+		fatal("refusing to start", err)
+	}
+
+	// traces of every request, query and TMDB call
+	app.shutdownTracing, err = app.setupTracing()
+	if err != nil {
+		fatal("failed to set up tracing", err)
+	}
+
+	app.rateLimits, err = app.newRateLimitStore(app.RateLimitStore)
+	if err != nil {
+		fatal("refusing to start", err)
+	}
+
+	app.mailer, err = app.newMailer()
+	if err != nil {
+		fatal("failed to set up the mailer", err)
+	}
+
+	// load the queries our front end is allowed to send
+	app.persistedQueries = graph.NewPersistedQueries()
+	if app.GraphQLManifest != "" {
+		err := app.persistedQueries.LoadManifest(app.GraphQLManifest)
+		if err != nil {
+			fatal("failed to load the persisted query manifest", err)
+		}
+	} else if app.GraphQLMode == graphQLModeAllowList {
+		slog.Warn("graphql allow-list mode without a manifest, only authenticated clients can query")
+	}
+
+	// TestRoutesAreDocumented keeps the OpenAPI spec from falling behind
+	// the code, this only tells whoever runs a build that skipped it
+	if undocumented, err := undocumentedRoutes(app.routes().(chi.Routes), openAPISpec); err != nil {
+		slog.Warn("failed to read openapi.json", "err", err)
+	} else if len(undocumented) > 0 {
+		slog.Warn("routes missing from openapi.json", "routes", undocumented)
+	}
 
 	// connect to database
 	conn, err := app.connectToDB()
@@ -58,33 +306,45 @@ func main() {
 	// the way we want to close them is just before the application exits
 	// defer app.DB.Close()
 	if err != nil {
-		log.Fatal(err)
+		fatal("failed to connect to postgres", err)
+	}
+	if app.Migrate {
+		if err := app.migrate(context.Background(), conn); err != nil {
+			fatal("failed to migrate the database", err)
+		}
 	}
 	//app.DB = conn
 	//defer app.DB.Close()
-	app.DB = &dbrepo.PostgresDBRepo{DB: conn}
-	//defer conn.Close()
-	defer app.DB.Connection().Close()
-
-	app.auth = Auth{
-		Issuer:        app.JWTIssuer,
-		Audience:      app.JWTAudience,
-		Secret:        app.JWTSecret,
-		TokenExpiry:   time.Minute * 15, // 15 mins
-		RefreshExpiry: time.Hour * 24,   // for 24 hours
-		CookiePath:    "/",              // the root level of our application
-		CookieName:    "__Host-refresh_token",
-		CookieDomain:  app.CookieDomain,
+	// every call to the database is timed for /metrics and traced
+	app.DB = &repository.ObservedRepo{
+		Repo:    &dbrepo.PostgresDBRepo{DB: conn},
+		Observe: observeRepo,
 	}
+	registerDBMetrics(conn)
+	// serve closes the pool once every request and worker is done with it
+
+	// ctx is cancelled when we're asked to stop (Ctrl+C, or a deploy
+	// sending SIGTERM)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	log.Println("Starting application on port ", port)
+	// empty the trash every now and then
+	app.startWorker(ctx, "trash-purge", app.purgeTrash)
+	// and forget the rate limits nobody has hit in a while
+	app.startWorker(ctx, "rate-limit-sweep", app.sweepRateLimits)
 
 	//http.HandleFunc("/", Hello)
 
 	// start a web server
-	err = http.ListenAndServe(fmt.Sprintf(":%d", port), app.routes())
-	if err != nil {
+	err = app.serve(ctx)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		// unable to start the server. Just die and log the error
-		log.Fatal(err)
+		fatal("server failed", err)
 	}
 }
+
+// fatal logs why we can't go on and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// everything we measure, served at /metrics for Prometheus to scrape.
+// we use a registry of our own instead of the global one, so only what we
+// put in here shows up
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by method, route pattern and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "How long HTTP requests took, by method and route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	httpRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "HTTP requests being served right now.",
+	})
+
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "How long repository calls took, by method.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 3},
+	}, []string{"method"})
+
+	dbQueryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_query_errors_total",
+		Help: "Repository calls that failed, by method. Not finding a row doesn't count.",
+	}, []string{"method"})
+
+	authLogins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_logins_total",
+		Help: "Login attempts by result (success, failure, locked, disabled or mfa_required).",
+	}, []string{"result"})
+
+	rateLimitedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_rate_limited_total",
+		Help: "Requests turned away with a 429, by limit.",
+	}, []string{"limit"})
+
+	tmdbRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tmdb_requests_total",
+		Help: "Poster lookups at TMDB by outcome (found, not_found or error).",
+	}, []string{"outcome"})
+
+	tmdbRequestDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tmdb_request_duration_seconds",
+		Help:    "How long poster lookups at TMDB took.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// the outcomes of a TMDB poster lookup
+const (
+	tmdbFound    = "found"
+	tmdbNotFound = "not_found"
+	tmdbError    = "error"
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpRequestDuration,
+		httpRequestsInFlight,
+		dbQueryDuration,
+		dbQueryErrors,
+		authLogins,
+		rateLimitedRequests,
+		tmdbRequests,
+		tmdbRequestDuration,
+	)
+}
+
+// registerDBMetrics adds the connection pool stats of db (open, in use,
+// idle, waits...) to /metrics
+func registerDBMetrics(db *sql.DB) {
+	metricsRegistry.MustRegister(collectors.NewDBStatsCollector(db, "movies"))
+}
+
+// observeQuery times a repository call, the function it returns is
+// called with the result once the call is done
+func observeQuery(ctx context.Context, method string) (context.Context, func(err error)) {
+	start := time.Now()
+	return ctx, func(err error) {
+		dbQueryDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			dbQueryErrors.WithLabelValues(method).Inc()
+		}
+	}
+}
+
+// Metrics serves everything in the registry in the Prometheus format
+func (app *application) Metrics() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// metrics counts and times every request. we label them with the route
+// pattern chi matched ("/v1/movies/{id}") and not the path, otherwise
+// every movie id would get a time series of its own
+func (app *application) metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		httpRequestsInFlight.Inc()
+		defer httpRequestsInFlight.Dec()
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		// chi fills in the pattern while routing, so it's only there
+		// once the request has been handled
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(sw.status)).Inc()
+		httpRequestDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// statusWriter remembers the status code a handler sent, and how much
+// it wrote
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if !sw.wroteHeader {
+		sw.status = status
+		sw.wroteHeader = true
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	sw.wroteHeader = true
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += n
+	return n, err
+}
+
+// Flush lets the export keep streaming through us
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the real connection, so
+// extendDeadlines still works
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
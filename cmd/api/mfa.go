@@ -0,0 +1,390 @@
+package main
+
+import (
+	"backend/internals/models"
+	"backend/internals/totp"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// what a user can be
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+)
+
+// the typ of the tokens GenerateMFAToken makes
+const mfaTokenType = "mfa"
+
+const (
+	// how many recovery codes a user gets, each works once instead of a
+	// code from their app
+	recoveryCodeCount = 10
+	// how many time steps off the clock of a phone can be, either way
+	totpSkew = 1
+)
+
+var (
+	errInvalidMFAToken = errors.New("the login has expired, log in again")
+	errInvalidMFACode  = errors.New("invalid code")
+	errMFAEnabled      = errors.New("two-factor authentication is already enabled")
+	errMFANotEnrolled  = errors.New("start enrolling first")
+	errMFANotEnabled   = errors.New("two-factor authentication isn't enabled")
+	errMFARequired     = errors.New("admins must log in with two-factor authentication, set it up first")
+	errMFAMandatory    = errors.New("two-factor authentication can't be turned off for admins")
+)
+
+// the codes are shown as two groups of five, in lower case so there's no
+// telling 0 from O
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newRecoveryCodes makes up a set of recovery codes, and the hashes of
+// them we store
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(b)[:10])
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a recovery code however the user typed it
+func hashRecoveryCode(code string) string {
+	code = strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(code)))
+	return hashMailToken(code)
+}
+
+// useSecondFactor tells whether code is a good code from the app of user,
+// or one of their recovery codes, and uses it up if it is
+func (app *application) useSecondFactor(ctx context.Context, user *models.User, code string) (bool, error) {
+	db := app.DB.WithContext(ctx)
+
+	if step, ok := totp.Validate(user.TOTPSecret, code, time.Now(), totpSkew); ok {
+		// a code somebody saw over the user's shoulder doesn't work twice
+		err := db.UseTOTPStep(user.ID, step)
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	err := db.UseRecoveryCode(user.ID, hashRecoveryCode(code))
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err == nil {
+		slog.InfoContext(ctx, "recovery code used", "user_id", user.ID)
+	}
+	return err == nil, err
+}
+
+// checkSecondFactor makes sure the user sending code (and password, when
+// checkPassword) is who they say, before they log in or change their
+// two-factor settings. see confirmUser
+func (app *application) checkSecondFactor(w http.ResponseWriter, r *http.Request, user *models.User, checkPassword bool, password, code string) bool {
+	fail := errInvalidMFACode
+	if checkPassword {
+		fail = errInvalidCredentials
+	}
+	return app.confirmUser(w, r, user, fail, func() (bool, error) {
+		if checkPassword {
+			// a recovery code isn't used up for a wrong password
+			if valid, err := user.PasswordMatches(password); err != nil || !valid {
+				return false, nil
+			}
+		}
+		return app.useSecondFactor(r.Context(), user, code)
+	})
+}
+
+// mfaChallenge answers a login with the right password of a user with
+// two-factor authentication: no tokens yet, but a short lived MFA token
+// to send to /authenticate/mfa with the code
+func (app *application) mfaChallenge(w http.ResponseWriter, user *models.User) {
+	token, err := app.auth.GenerateMFAToken(&jwtUser{ID: user.ID, TokenVersion: user.TokenVersion})
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	authLogins.WithLabelValues("mfa_required").Inc()
+
+	_ = app.writeJSON(w, http.StatusAccepted, struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+	}{true, token})
+}
+
+// path: POST /authenticate/mfa
+// the second step of logging in with two-factor authentication: the MFA
+// token from /authenticate and a code from the app, or a recovery code
+func (app *application) authenticateMFA(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+	if err := app.readJSON(w, r, &payload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	claims, err := app.auth.ParseMFAToken(payload.MFAToken)
+	if err != nil {
+		app.errorJSON(w, errInvalidMFAToken, http.StatusUnauthorized)
+		return
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		app.errorJSON(w, errInvalidMFAToken, http.StatusUnauthorized)
+		return
+	}
+	user, err := app.db(r).GetUserByID(userID)
+	// the password was reset, two-factor authentication turned off, or
+	// the account disabled, since the token was issued
+	if err != nil || claims.TokenVersion != user.TokenVersion || !user.MFAEnabled() || user.Disabled() {
+		app.errorJSON(w, errInvalidMFAToken, http.StatusUnauthorized)
+		return
+	}
+
+	if !app.checkSecondFactor(w, r, user, false, "", payload.Code) {
+		return
+	}
+	authLogins.WithLabelValues("success").Inc()
+	app.logIn(w, user, true)
+}
+
+// requestUser is the user the access token of the request is for
+func (app *application) requestUser(r *http.Request) (*models.User, error) {
+	claims := claimsFromContext(r.Context())
+	if claims == nil {
+		return nil, errors.New("unknown user")
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil, errors.New("unknown user")
+	}
+	user, err := app.db(r).GetUserByID(userID)
+	if err != nil {
+		return nil, errors.New("unknown user")
+	}
+	// their access token still works for a bit after they're disabled
+	if user.Disabled() {
+		return nil, errAccountDisabled
+	}
+	return user, nil
+}
+
+// path: GET /mfa
+// the two-factor authentication settings of the logged in user
+func (app *application) MFAStatus(w http.ResponseWriter, r *http.Request) {
+	user, err := app.requestUser(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	var codesLeft int
+	if user.MFAEnabled() {
+		codesLeft, err = app.db(r).CountRecoveryCodes(user.ID)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, struct {
+		Enabled           bool `json:"enabled"`
+		Required          bool `json:"required"`
+		RecoveryCodesLeft int  `json:"recovery_codes_left"`
+	}{user.MFAEnabled(), app.mfaRequiredFor(user.Role), codesLeft})
+}
+
+// path: POST /mfa/totp/enroll
+// the first step of turning on two-factor authentication: a new secret
+// for the user to add to their app, by hand or by scanning the otpauth://
+// URI as a QR code. nothing changes until they confirm it with a code
+func (app *application) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	user, err := app.requestUser(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+	if user.MFAEnabled() {
+		app.errorJSON(w, errMFAEnabled, http.StatusConflict)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := app.db(r).SetPendingTOTP(user.ID, secret); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errMFAEnabled, http.StatusConflict)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, struct {
+		Secret string `json:"secret"`
+		URI    string `json:"otpauth_uri"`
+	}{secret, totp.URI(app.MFAIssuer, user.Email, secret)})
+}
+
+// path: POST /mfa/totp/confirm
+// turns on two-factor authentication once the user shows their app makes
+// the right codes. the answer has their recovery codes, the only time we
+// ever show them. every session of the user ends, they log in again with
+// a code
+func (app *application) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Code string `json:"code"`
+	}
+	if err := app.readJSON(w, r, &payload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.requestUser(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+	if user.MFAEnabled() {
+		app.errorJSON(w, errMFAEnabled, http.StatusConflict)
+		return
+	}
+	if user.TOTPSecret == "" {
+		app.errorJSON(w, errMFANotEnrolled, http.StatusConflict)
+		return
+	}
+
+	step, ok := totp.Validate(user.TOTPSecret, payload.Code, time.Now(), totpSkew)
+	if !ok {
+		app.errorJSON(w, errInvalidMFACode, http.StatusUnprocessableEntity)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := app.db(r).EnableTOTP(user.ID, step, hashes); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errMFAEnabled, http.StatusConflict)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "two-factor authentication enabled", "user_id", user.ID)
+
+	http.SetCookie(w, app.auth.GetExpiredRefreshCookie())
+	_ = app.writeJSON(w, http.StatusOK, struct {
+		Message       string   `json:"message"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{"two-factor authentication enabled, log in again with a code", codes})
+}
+
+// path: POST /mfa/recovery-codes
+// a new set of recovery codes for a user who is running out, the old ones
+// stop working. it takes a code from the app (or a recovery code)
+func (app *application) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Code string `json:"code"`
+	}
+	if err := app.readJSON(w, r, &payload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.requestUser(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+	if !user.MFAEnabled() {
+		app.errorJSON(w, errMFANotEnabled, http.StatusConflict)
+		return
+	}
+	if !app.checkSecondFactor(w, r, user, false, "", payload.Code) {
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := app.db(r).ReplaceRecoveryCodes(user.ID, hashes); err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "recovery codes replaced", "user_id", user.ID)
+
+	_ = app.writeJSON(w, http.StatusOK, struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{codes})
+}
+
+// path: POST /mfa/totp/disable
+// turns off two-factor authentication, with the password and a code.
+// every session of the user ends. admins can't when it's required for them
+func (app *application) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := app.readJSON(w, r, &payload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.requestUser(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+	if !user.MFAEnabled() {
+		app.errorJSON(w, errMFANotEnabled, http.StatusConflict)
+		return
+	}
+	if app.mfaRequiredFor(user.Role) {
+		app.errorJSON(w, errMFAMandatory, http.StatusForbidden)
+		return
+	}
+	if !app.checkSecondFactor(w, r, user, true, payload.Password, payload.Code) {
+		return
+	}
+
+	if err := app.db(r).DisableTOTP(user.ID); err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "two-factor authentication disabled", "user_id", user.ID)
+
+	http.SetCookie(w, app.auth.GetExpiredRefreshCookie())
+	_ = app.writeJSON(w, http.StatusOK, JSONResponse{Message: "two-factor authentication disabled, log in again"})
+}
+
+// mfaRequiredFor tells whether users with role have to log in with
+// two-factor authentication
+func (app *application) mfaRequiredFor(role string) bool {
+	return app.RequireAdminMFA && role == roleAdmin
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"backend/internals/models"
+	"backend/internals/repository"
+	"backend/internals/totp"
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// totpRepo keeps the last step a user logged in with, the way
+// UseTOTPStep does in postgres
+type totpRepo struct {
+	repository.DatabaseRepo
+	lastStep int64
+}
+
+func (db *totpRepo) WithContext(ctx context.Context) repository.DatabaseRepo { return db }
+
+func (db *totpRepo) UseTOTPStep(userID int, step int64) error {
+	if step <= db.lastStep {
+		return sql.ErrNoRows
+	}
+	db.lastStep = step
+	return nil
+}
+
+func (db *totpRepo) UseRecoveryCode(userID int, codeHash string) error {
+	return sql.ErrNoRows
+}
+
+func TestUseSecondFactorRefusesReplay(t *testing.T) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &application{DB: &totpRepo{}}
+	user := &models.User{ID: 1, TOTPSecret: secret}
+	step := totp.Step(time.Now())
+
+	code, _ := totp.Code(secret, step)
+	if ok, err := app.useSecondFactor(context.Background(), user, code); !ok || err != nil {
+		t.Fatalf("the current code: got %v, %v", ok, err)
+	}
+	if ok, _ := app.useSecondFactor(context.Background(), user, code); ok {
+		t.Error("the same code worked twice")
+	}
+
+	// an older code, still inside the skew, doesn't work after a newer one
+	previous, _ := totp.Code(secret, step-1)
+	if ok, _ := app.useSecondFactor(context.Background(), user, previous); ok {
+		t.Error("the code of the step before worked after the current one")
+	}
+}
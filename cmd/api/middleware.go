@@ -1,6 +1,49 @@
 package main
 
-import "net/http"
+import (
+	"backend/internals/repository"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how long we remember an Idempotency-Key and the response we gave for it
+const idempotencyKeyTTL = 24 * time.Hour
+
+// the response headers we keep for replaying an idempotent request
+var idempotentHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// a type of our own for context keys, so we can't collide with keys
+// set by some other package
+type contextKey string
+
+const (
+	claimsContextKey     contextKey = "claims"
+	apiVersionContextKey contextKey = "api-version"
+)
+
+// claimsFromContext gives back the claims of the access token that
+// authRequired put in the request context, or nil if there aren't any
+func claimsFromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsContextKey).(*Claims)
+	return claims
+}
+
+// db is the repository bound to the request, so its queries are cancelled
+// when the request is and what it logs carries the request id
+func (app *application) db(r *http.Request) repository.DatabaseRepo {
+	return app.DB.WithContext(r.Context())
+}
 
 // middlewares
 // middleware is logic that runs on a request
@@ -8,39 +51,349 @@ import "net/http"
 // middleware runs against it
 // (here all we're doing is modifying the request
 // as it comes in.)
+//
+// enableCORS lets the web sites in app.cors call us from a browser. the
+// browser tells us which site the page came from in the Origin header,
+// when it's one we allow we send that origin back, and the browser lets
+// the page see the response. anybody else is turned away
 func (app *application) enableCORS(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// set header
-		// any http request should be permitted by our system
-		//w.Header().Set("Access-Control-Allow-Origin", "http://localhost:8080")
-		w.Header().Set("Access-Control-Allow-Origin", "http://*")
-		//w.Header().Set("Access-Control-Allow-Origin", "https://learn-code.ca")
-
-		// if we have a request named "OPTIONS"
-		// OPTIONS request
-		if r.Method == "OPTIONS" {
+		// the answer depends on the Origin header, caches need to know that
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		if origin == "" || sameOrigin(r, origin) {
+			// not a cross-origin request, nothing for us to do
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// a preflight is the OPTIONS request a browser sends to ask
+		// whether the real request is allowed
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		if !app.cors.originAllowed(origin) {
+			_ = app.errorJSON(w, errOriginNotAllowed, http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if app.cors.AllowCredentials {
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
-			// with forms we use GET and POST
-			// but with REST api we need to allow other as well
-			w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, X-CSRF-Token, Authorization")
+		}
+
+		if preflight {
+			if !app.cors.methodAllowed(r.Header.Get("Access-Control-Request-Method")) ||
+				!app.cors.headersAllowed(r.Header.Get("Access-Control-Request-Headers")) {
+				// leaving out the allow headers is how we say no, the
+				// browser won't send the real request
+				w.Header().Del("Access-Control-Allow-Origin")
+				w.Header().Del("Access-Control-Allow-Credentials")
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			app.cors.setPreflightHeaders(w, r)
+			w.WriteHeader(http.StatusNoContent)
 			return
-		} else {
-			h.ServeHTTP(w, r)
 		}
+
+		// let the front end read the validators it needs for If-Match
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		h.ServeHTTP(w, r)
 	})
 }
 
 func (app *application) authRequired(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// we don't care about the token and claims
-		// we only need to check for error
-		_, _, err := app.auth.GetTokenFromHeaderAndVerify(w, r)
+		// we don't care about the token itself, but we keep the claims
+		// so handlers know who is making the request
+		_, claims, err := app.auth.GetTokenFromHeaderAndVerify(w, r)
 		if err != nil {
 			// then the user is not authorize
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+
+		// a valid signature isn't enough: the user may have been disabled,
+		// demoted or logged out everywhere (their token version went up)
+		// since the token was issued
+		userID, err := strconv.Atoi(claims.Subject)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		user, err := app.db(r).GetUserByID(userID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+		if user.Disabled() {
+			app.errorJSON(w, errAccountDisabled, http.StatusUnauthorized)
+			return
+		}
+		if claims.TokenVersion != user.TokenVersion {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// a user an admin created logs in with a temporary password that
+		// was passed on by hand. until they've picked their own, the only
+		// thing their token is good for is changing it
+		if user.PasswordChangeRequired && !(r.Method == http.MethodPost &&
+			unversionedPath(r.URL.Path, apiVersionFromContext(r.Context())) == "/me/password") {
+			app.errorJSON(w, errPasswordChangeRequired, http.StatusForbidden)
+			return
+		}
+
+		setRequestUser(r.Context(), claims.Subject)
+		ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// verifiedRequired turns away the users who haven't verified their email
+// address yet. it goes after authRequired, on the routes where what a user
+// does shows up for everybody else (everything under /admin)
+func (app *application) verifiedRequired(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := claimsFromContext(r.Context())
+		if claims == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !claims.EmailVerified {
+			app.errorJSON(w, errEmailNotVerified, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// mfaRequired turns away admins who logged in with only a password, when
+// app.RequireAdminMFA says they need a second factor. it goes after
+// authRequired. they can still set up two-factor authentication, /mfa
+// isn't behind this
+func (app *application) mfaRequired(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := claimsFromContext(r.Context())
+		if claims == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if app.mfaRequiredFor(claims.Role) && !claims.MFA {
+			app.errorJSON(w, errMFARequired, http.StatusForbidden)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// adminRequired turns away everybody who isn't an admin. it goes after
+// authRequired
+func (app *application) adminRequired(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := claimsFromContext(r.Context())
+		if claims == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if claims.Role != roleAdmin {
+			app.errorJSON(w, errAdminRequired, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// idempotent lets a client safely retry a request that creates something.
+// the client sends a unique Idempotency-Key header, the first request with
+// that key is handled normally and we store the response, any retry with
+// the same key gets the stored response back instead of creating the
+// thing a second time. keys belong to a user, so this goes after
+// authRequired
+func (app *application) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			// no key, no promises
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > 255 {
+			app.errorJSON(w, errors.New("Idempotency-Key is too long"))
+			return
+		}
+
+		userID := 0
+		if claims := claimsFromContext(r.Context()); claims != nil {
+			userID, _ = strconv.Atoi(claims.Subject)
+		}
+
+		// we remember what the request looked like, so a key can't be
+		// reused for a different request by mistake
+		r.Body = http.MaxBytesReader(w, r.Body, 1024*1024)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		// /admin/movies and /v1/admin/movies are the same route, a retry
+		// can go to either
+		version := apiVersionFromContext(r.Context())
+		path := unversionedPath(r.URL.Path, version)
+		sum := sha256.Sum256([]byte(r.Method + " " + version + " " + path + "\n" + string(body)))
+		requestHash := hex.EncodeToString(sum[:])
+
+		record, fresh, err := app.db(r).ReserveIdempotencyKey(key, userID, requestHash)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		if !fresh {
+			switch {
+			case record.RequestHash != requestHash:
+				app.errorJSON(w, errors.New("this Idempotency-Key was already used for a different request"), http.StatusUnprocessableEntity)
+			case record.StatusCode == 0:
+				app.errorJSON(w, errors.New("a request with this Idempotency-Key is still being processed"), http.StatusConflict)
+			default:
+				// the same answer as the first time
+				for name, values := range record.Header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(record.StatusCode)
+				_, _ = w.Write(record.Body)
+			}
+			return
+		}
+
+		release := func() {
+			if err := app.db(r).ReleaseIdempotencyKey(key, userID); err != nil {
+				slog.ErrorContext(r.Context(), "failed to release idempotency key", "err", err)
+			}
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		func() {
+			// a panic ends up as a 500, the key mustn't stay reserved or
+			// every retry would be told it's still being processed
+			defer func() {
+				if err := recover(); err != nil {
+					release()
+					panic(err)
+				}
+			}()
+			next.ServeHTTP(rec, r)
+		}()
+
+		// only successful responses are worth remembering, if it failed
+		// the client should be able to fix the problem and try again
+		if rec.status < 200 || rec.status > 299 {
+			release()
+			return
+		}
+
+		record.StatusCode = rec.status
+		record.Header = make(http.Header)
+		for _, name := range idempotentHeaders {
+			if value := w.Header().Get(name); value != "" {
+				record.Header.Set(name, value)
+			}
+		}
+		record.Body = rec.body.Bytes()
+		if err := app.db(r).CompleteIdempotencyKey(*record); err != nil {
+			slog.ErrorContext(r.Context(), "failed to store idempotent response", "err", err)
+		}
+	})
+}
+
+// responseRecorder passes a response through to the client and keeps
+// a copy of the status and body
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if !rr.wroteHeader {
+		rr.status = status
+		rr.wroteHeader = true
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.wroteHeader = true
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+// deprecated marks a route as on its way out (RFC 9745). clients get a
+// Deprecation header saying since when, a Sunset header (RFC 8594) saying
+// when it goes away if we know, and a Link to what to use instead
+func deprecated(since, sunset time.Time, successor string) func(http.Handler) http.Handler {
+	return deprecatedFor(since, sunset, func(*http.Request) string { return successor })
+}
+
+// deprecatedFor is deprecated for when the replacement depends on the
+// request, like the same path under a new version
+func deprecatedFor(since, sunset time.Time, successor func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// a route can be marked twice (an old route that's also
+			// unversioned), the dates set first win but every
+			// replacement gets its link
+			if w.Header().Get("Deprecation") == "" {
+				w.Header().Set("Deprecation", fmt.Sprintf("@%d", since.Unix()))
+			}
+			if !sunset.IsZero() && w.Header().Get("Sunset") == "" {
+				w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+			}
+			if link := successor(r); link != "" {
+				w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", link))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// apiVersion tells handlers (and clients) which version of the API is
+// answering the request
+func apiVersion(version string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("API-Version", version)
+			ctx := context.WithValue(r.Context(), apiVersionContextKey, version)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// unversionedPath takes the version prefix off path, /v1/me becomes /me.
+// a path without one stays as it is
+func unversionedPath(path, version string) string {
+	if rest := strings.TrimPrefix(path, "/"+version); strings.HasPrefix(rest, "/") {
+		return rest
+	}
+	return path
+}
+
+// apiVersionFromContext gives back the version apiVersion put in the context
+func apiVersionFromContext(ctx context.Context) string {
+	version, _ := ctx.Value(apiVersionContextKey).(string)
+	if version == "" {
+		return "v1"
+	}
+	return version
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// the OpenAPI 3.1 description of the API. it's written by hand and built
+// into the binary, so what we serve is always the one that matches the code
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// OpenAPI serves the API description
+func (app *application) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", contentETag(openAPISpec))
+	if notModified(w, r) {
+		writeNotModified(w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(openAPISpec)
+}
+
+// the part of the spec we need to see which routes are documented
+type openAPIDocument struct {
+	Paths map[string]map[string]json.RawMessage `json:"paths"`
+}
+
+// undocumentedRoutes walks every route registered in the router and returns
+// the ones that aren't in the spec, as "METHOD /path". the spec describes
+// paths relative to /v1, the unversioned aliases are the same routes so
+// they're checked against the same paths
+func undocumentedRoutes(routes chi.Routes, spec []byte) ([]string, error) {
+	var doc openAPIDocument
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, fmt.Errorf("reading openapi spec: %w", err)
+	}
+
+	missing := make(map[string]bool)
+	err := chi.Walk(routes, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		path := strings.TrimPrefix(route, "/v1")
+		if path != "/" {
+			path = strings.TrimSuffix(path, "/")
+		}
+		if path == "" {
+			path = "/"
+		}
+
+		// chi uses the same {param} syntax as OpenAPI, so the paths
+		// can be compared as they are
+		if _, ok := doc.Paths[path][strings.ToLower(method)]; !ok {
+			missing[method+" "+path] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for route := range missing {
+		out = append(out, route)
+	}
+	sort.Strings(out)
+	return out, nil
+}
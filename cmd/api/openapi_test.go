@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// every route in the router has to be in openapi.json, so the spec can't
+// quietly fall behind the code
+func TestRoutesAreDocumented(t *testing.T) {
+	app := &application{}
+	undocumented, err := undocumentedRoutes(app.routes().(chi.Routes), openAPISpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(undocumented) > 0 {
+		t.Errorf("routes missing from openapi.json: %s", strings.Join(undocumented, ", "))
+	}
+}
+
+func TestUndocumentedRoutes(t *testing.T) {
+	spec, _ := json.Marshal(map[string]interface{}{
+		"paths": map[string]interface{}{
+			"/":            map[string]interface{}{"get": map[string]interface{}{}},
+			"/movies/{id}": map[string]interface{}{"get": map[string]interface{}{}},
+		},
+	})
+
+	mux := chi.NewRouter()
+	mux.Route("/v1", func(mux chi.Router) {
+		mux.Get("/", http.NotFound)
+		mux.Get("/movies/{id}", http.NotFound)
+		mux.Delete("/movies/{id}", http.NotFound)
+	})
+	mux.Get("/movies/{id}", http.NotFound)
+	mux.Post("/graph", http.NotFound)
+
+	got, err := undocumentedRoutes(mux, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "DELETE /movies/{id}, POST /graph"
+	if strings.Join(got, ", ") != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+}
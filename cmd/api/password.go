@@ -0,0 +1,300 @@
+package main
+
+import (
+	"backend/internals/mailer"
+	"backend/internals/models"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// the bcrypt cost of the password hashes we make, the same as the hashes
+// already in the database (and dummyPasswordHash)
+const passwordHashCost = 14
+
+// bcrypt only looks at the first 72 bytes, a longer password would have
+// the rest ignored without anybody noticing
+const maxPasswordBytes = 72
+
+// where the emails we send go
+const (
+	mailerSMTP = "smtp"
+	// appended to mail-file
+	mailerFile = "file"
+	// written to stderr, among the logs
+	mailerLog = "log"
+)
+
+var errInvalidResetToken = errors.New("the reset link is invalid or has expired, ask for a new one")
+
+// passwords everybody tries first. the length rule already rules out
+// most of them, these are the long ones
+var commonPasswords = map[string]bool{
+	"123456789012":     true,
+	"1234567890123":    true,
+	"password1234":     true,
+	"passwordpassword": true,
+	"qwertyuiop12":     true,
+	"qwertyuiopasdf":   true,
+	"iloveyou1234":     true,
+	"letmein12345":     true,
+	"administrator":    true,
+	"changeme1234":     true,
+	"welcome12345":     true,
+	"aaaaaaaaaaaa":     true,
+}
+
+// passwordPolicy is what a new password has to be like
+type passwordPolicy struct {
+	MinLength int
+}
+
+// check tells what's wrong with password as the new password of the user
+// with email, nothing when it's fine
+func (p passwordPolicy) check(password, email string) []string {
+	var problems []string
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		problems = append(problems, fmt.Sprintf("password must be at least %d characters", p.MinLength))
+	}
+	if len(password) > maxPasswordBytes {
+		problems = append(problems, fmt.Sprintf("password can be at most %d bytes", maxPasswordBytes))
+	}
+
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		problems = append(problems, "password is too common")
+	}
+	if local, _, ok := strings.Cut(strings.ToLower(email), "@"); ok && len(local) >= 4 && strings.Contains(lower, local) {
+		problems = append(problems, "password can't contain your email address")
+	}
+	return problems
+}
+
+// hashPassword is the bcrypt hash we store for password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordHashCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// newMailToken makes up a token to mail (for a password reset or an email
+// verification), and the hash of it we store
+func newMailToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashMailToken(token), nil
+}
+
+func hashMailToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// path: POST /password/forgot
+// mails a link to reset the password to the address, when it belongs to
+// somebody. the answer is the same either way, and comes before we even
+// look, so neither it nor the time it takes gives away who has an account
+func (app *application) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+	if err := app.readJSON(w, r, &payload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	if strings.TrimSpace(payload.Email) == "" {
+		app.errorJSON(w, errors.New("email is required"), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// the request is over by the time this runs, but its logs should
+	// still carry its request id
+	ctx := context.WithoutCancel(r.Context())
+	app.background(func() {
+		app.sendPasswordReset(ctx, payload.Email)
+	})
+
+	_ = app.writeJSON(w, http.StatusAccepted, JSONResponse{
+		Message: "if the address belongs to an account, a link to reset its password is on the way",
+	})
+}
+
+// sendPasswordReset stores a new reset token for the user with email and
+// mails it to them
+func (app *application) sendPasswordReset(ctx context.Context, email string) {
+	db := app.DB.WithContext(ctx)
+
+	user, err := db.GetUserByEmail(email)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.ErrorContext(ctx, "failed to look up the user for a password reset", "err", err)
+		}
+		return
+	}
+
+	token, hash, err := newMailToken()
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to make a password reset token", "err", err)
+		return
+	}
+	now := time.Now()
+	err = db.CreatePasswordReset(models.PasswordReset{
+		TokenHash: hash,
+		UserID:    user.ID,
+		ExpiresAt: now.Add(app.PasswordResetExpiry),
+		CreatedAt: now,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to store a password reset token", "user_id", user.ID, "err", err)
+		return
+	}
+
+	link := strings.TrimSuffix(app.FrontendURL, "/") + "/reset-password?token=" + url.QueryEscape(token)
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Text: fmt.Sprintf("Hi %s,\n\n"+
+			"somebody (hopefully you) asked to reset the password of your account.\n"+
+			"To choose a new one, open this link in the next %s:\n\n"+
+			"%s\n\n"+
+			"If it wasn't you, ignore this email and your password stays as it is.\n",
+			user.FirstName, inWords(app.PasswordResetExpiry), link),
+	}
+	if err := app.mailer.Send(ctx, msg); err != nil {
+		slog.ErrorContext(ctx, "failed to send the password reset email", "user_id", user.ID, "err", err)
+		return
+	}
+	slog.InfoContext(ctx, "sent a password reset email", "user_id", user.ID)
+}
+
+// inWords says a duration the way you'd write it in an email, "1 hour"
+// instead of 1h0m0s
+func inWords(d time.Duration) string {
+	plural := func(n int64, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s", unit)
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	switch {
+	case d >= time.Hour && d%time.Hour == 0:
+		return plural(int64(d/time.Hour), "hour")
+	case d >= time.Minute && d%time.Minute == 0:
+		return plural(int64(d/time.Minute), "minute")
+	}
+	return d.String()
+}
+
+// path: POST /password/reset
+// sets a new password with the token we mailed. the token works once, and
+// every session of the user (every refresh token) stops working
+func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := app.readJSON(w, r, &payload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	hash := hashMailToken(payload.Token)
+	reset, err := app.db(r).GetPasswordReset(hash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errInvalidResetToken)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	user, err := app.db(r).GetUserByID(reset.UserID)
+	if err != nil {
+		app.errorJSON(w, errInvalidResetToken)
+		return
+	}
+
+	if problems := app.passwordPolicy.check(payload.Password, user.Email); len(problems) > 0 {
+		app.errorJSON(w, errors.New(strings.Join(problems, ", ")), http.StatusUnprocessableEntity)
+		return
+	}
+
+	passwordHash, err := hashPassword(payload.Password)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// somebody else could have used the token while we were hashing
+	if _, err := app.db(r).ResetPassword(hash, passwordHash); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errInvalidResetToken)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "password reset", "user_id", user.ID)
+
+	// whoever got the account locked out by guessing, the owner can
+	// log in again now
+	if err := app.loginSucceeded(r.Context(), user.Email); err != nil {
+		slog.WarnContext(r.Context(), "failed to clear the failed logins", "err", err)
+	}
+
+	// this browser is logged out too
+	http.SetCookie(w, app.auth.GetExpiredRefreshCookie())
+	_ = app.writeJSON(w, http.StatusOK, JSONResponse{Message: "password changed, log in with the new password"})
+}
+
+// expirePasswordResets forgets reset tokens that ran out a day ago
+func (app *application) expirePasswordResets() {
+	_, err := app.DB.DeletePasswordResets(time.Now().Add(-24 * time.Hour))
+	if err != nil {
+		slog.Error("failed to expire password reset tokens", "err", err)
+	}
+}
+
+// newMailer is the mailer the settings ask for
+func (app *application) newMailer() (mailer.Mailer, error) {
+	switch app.Mailer {
+	case mailerSMTP:
+		return &mailer.SMTPMailer{
+			Host:     app.SMTPHost,
+			Port:     app.SMTPPort,
+			Username: app.SMTPUsername,
+			Password: app.SMTPPassword,
+			From:     app.MailFrom,
+		}, nil
+	case mailerFile:
+		f, err := os.OpenFile(app.MailFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		return &mailer.WriterMailer{From: app.MailFrom, W: f}, nil
+	case mailerLog:
+		return &mailer.WriterMailer{From: app.MailFrom, W: os.Stderr}, nil
+	}
+	return nil, fmt.Errorf("unknown mailer %q (smtp|file|log)", app.Mailer)
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"backend/internals/models"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the content types a PATCH can come in
+const (
+	mergePatchContentType = "application/merge-patch+json" // RFC 7396
+	jsonPatchContentType  = "application/json-patch+json"  // RFC 6902
+)
+
+// movieDocument is the part of a movie a PATCH can change, it's the
+// document the patch is applied to
+type movieDocument struct {
+	Title       string    `json:"title"`
+	ReleaseDate time.Time `json:"release_date"`
+	RunTime     int       `json:"runtime"`
+	MPAARating  string    `json:"mpaa_rating"`
+	Description string    `json:"description"`
+	Image       string    `json:"image"`
+	GenresArray []int     `json:"genres_array"`
+}
+
+// fields of a movie that can show up in a patch (because the client sent
+// back what it got from GET) but can't be changed through one
+var readOnlyMovieFields = []string{"id", "genres", "external_id", "deleted_at"}
+
+// patchMovie applies a patch to a movie and gives back the patched movie.
+// a merge patch (or plain JSON, which is what our front end sends) only
+// changes the fields it mentions, null removes a field. a JSON patch is a
+// list of operations. either way the id in the URL is the movie we change
+func patchMovie(movie *models.Movie, contentType string, body []byte) (*models.Movie, error) {
+	doc, err := toGeneric(movieDocument{
+		Title:       movie.Title,
+		ReleaseDate: movie.ReleaseDate,
+		RunTime:     movie.RunTime,
+		MPAARating:  movie.MPAARating,
+		Description: movie.Description,
+		Image:       movie.Image,
+		GenresArray: movie.GenresArray,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// a movie without genres has a null genres_array, make it an empty
+	// list so "add /genres_array/-" works
+	if m, ok := doc.(map[string]interface{}); ok && m["genres_array"] == nil {
+		m["genres_array"] = []interface{}{}
+	}
+
+	if mediaType(contentType) == jsonPatchContentType {
+		var ops []jsonPatchOperation
+		if err := decodeJSONStrict(body, &ops); err != nil {
+			return nil, err
+		}
+		doc, err = applyJSONPatch(doc, ops)
+	} else {
+		var patch interface{}
+		if err := decodeJSONStrict(body, &patch); err != nil {
+			return nil, err
+		}
+		if _, ok := patch.(map[string]interface{}); !ok {
+			return nil, errors.New("a merge patch must be a JSON object")
+		}
+		doc = applyMergePatch(doc, patch)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fields, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("the patched movie must be a JSON object")
+	}
+	if id, ok := fields["id"]; ok && fmt.Sprint(id) != strconv.Itoa(movie.ID) {
+		return nil, errors.New("the id in the body does not match the id in the URL")
+	}
+	for _, name := range readOnlyMovieFields {
+		delete(fields, name)
+	}
+
+	// back from a generic document to a movie, anything we don't know
+	// about is an error, same as readJSON
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	var patched movieDocument
+	if err := decodeJSONStrict(out, &patched); err != nil {
+		return nil, err
+	}
+
+	result := *movie
+	result.Title = patched.Title
+	result.ReleaseDate = patched.ReleaseDate
+	result.RunTime = patched.RunTime
+	result.MPAARating = patched.MPAARating
+	result.Description = patched.Description
+	result.Image = patched.Image
+	result.GenresArray = patched.GenresArray
+	result.Genres = nil
+
+	if problems := validateMovie(&result); len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, ", "))
+	}
+
+	return &result, nil
+}
+
+// validateMovie checks what a movie needs before we save it, the same
+// rules the import uses for the fields. the import also wants at least one
+// genre, a movie edited here can do without
+func validateMovie(movie *models.Movie) []string {
+	var problems []string
+	if strings.TrimSpace(movie.Title) == "" {
+		problems = append(problems, "title is required")
+	} else if len(movie.Title) > 512 {
+		problems = append(problems, "title is longer than 512 characters")
+	}
+	if movie.ReleaseDate.IsZero() {
+		problems = append(problems, "release_date is required")
+	}
+	if movie.RunTime <= 0 {
+		problems = append(problems, "runtime must be a whole number of minutes")
+	}
+	if !mpaaRatings[movie.MPAARating] {
+		problems = append(problems, fmt.Sprintf("mpaa_rating %q is not a rating we know", movie.MPAARating))
+	}
+	if strings.TrimSpace(movie.Description) == "" {
+		problems = append(problems, "description is required")
+	}
+	return problems
+}
+
+// decodeJSONStrict decodes exactly one JSON value and refuses unknown fields
+func decodeJSONStrict(body []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("body must only contain a single JSON value")
+	}
+	return nil
+}
+
+// applyMergePatch is the algorithm from RFC 7396 section 2
+func applyMergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+			continue
+		}
+		targetObject[name] = applyMergePatch(targetObject[name], value)
+	}
+	return targetObject
+}
+
+// one operation of an RFC 6902 JSON patch
+type jsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// applyJSONPatch runs the operations in order. if any of them fails the
+// whole patch fails and nothing is changed (RFC 6902 section 5)
+func applyJSONPatch(doc interface{}, ops []jsonPatchOperation) (interface{}, error) {
+	for i, op := range ops {
+		var value interface{}
+		if len(op.Value) > 0 {
+			dec := json.NewDecoder(bytes.NewReader(op.Value))
+			dec.UseNumber()
+			if err := dec.Decode(&value); err != nil {
+				return nil, fmt.Errorf("operation %d: %w", i, err)
+			}
+		}
+
+		var err error
+		switch op.Op {
+		case "add":
+			doc, err = pointerAdd(doc, op.Path, value)
+		case "remove":
+			doc, _, err = pointerRemove(doc, op.Path)
+		case "replace":
+			doc, _, err = pointerRemove(doc, op.Path)
+			if err == nil {
+				doc, err = pointerAdd(doc, op.Path, value)
+			}
+		case "move":
+			var moved interface{}
+			if strings.HasPrefix(op.Path, op.From+"/") {
+				err = errors.New("can't move a value into itself")
+				break
+			}
+			doc, moved, err = pointerRemove(doc, op.From)
+			if err == nil {
+				doc, err = pointerAdd(doc, op.Path, moved)
+			}
+		case "copy":
+			var copied interface{}
+			copied, err = pointerGet(doc, op.From)
+			if err == nil {
+				doc, err = pointerAdd(doc, op.Path, copied)
+			}
+		case "test":
+			var current interface{}
+			current, err = pointerGet(doc, op.Path)
+			if err == nil && !jsonEqual(current, value) {
+				err = fmt.Errorf("test failed for %s", op.Path)
+			}
+		default:
+			err = fmt.Errorf("unknown op %q", op.Op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	return doc, nil
+}
+
+// splitPointer turns an RFC 6901 JSON pointer into its reference tokens
+func splitPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid path %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex reads an array index from a pointer token. "-" (the end of
+// the array) is only allowed when we're adding
+func arrayIndex(token string, length int, adding bool) (int, error) {
+	if token == "-" && adding {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if i > length || (!adding && i == length) {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+func pointerGet(doc interface{}, pointer string) (interface{}, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	current := doc
+	for _, token := range tokens {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("path %s does not exist", pointer)
+			}
+			current = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			current = node[i]
+		default:
+			return nil, fmt.Errorf("path %s does not exist", pointer)
+		}
+	}
+	return current, nil
+}
+
+// pointerAdd sets the value at pointer, inserting into arrays, and
+// returns the (possibly new) document
+func pointerAdd(doc interface{}, pointer string, value interface{}) (interface{}, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := pointerGet(doc, parentPointer)
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return doc, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(node), true)
+		if err != nil {
+			return nil, err
+		}
+		node = append(node, nil)
+		copy(node[i+1:], node[i:])
+		node[i] = value
+		// the slice may have moved, put it back into its parent
+		return pointerSet(doc, parentPointer, node)
+	default:
+		return nil, fmt.Errorf("path %s does not exist", pointer)
+	}
+}
+
+// pointerRemove takes away the value at pointer and returns the document
+// and the value that was there
+func pointerRemove(doc interface{}, pointer string) (interface{}, interface{}, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, doc, nil
+	}
+
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := pointerGet(doc, parentPointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	last := tokens[len(tokens)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		value, ok := node[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("path %s does not exist", pointer)
+		}
+		delete(node, last)
+		return doc, value, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := node[i]
+		node = append(node[:i:i], node[i+1:]...)
+		doc, err = pointerSet(doc, parentPointer, node)
+		return doc, value, err
+	default:
+		return nil, nil, fmt.Errorf("path %s does not exist", pointer)
+	}
+}
+
+// pointerSet replaces whatever is at pointer with value
+func pointerSet(doc interface{}, pointer string, value interface{}) (interface{}, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	parent, err := pointerGet(doc, pointer[:strings.LastIndex(pointer, "/")])
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+	case []interface{}:
+		i, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = value
+	}
+	return doc, nil
+}
+
+// jsonEqual compares two JSON values, numbers by value so 1 and 1.0 match
+func jsonEqual(a, b interface{}) bool {
+	normalise := func(v interface{}) interface{} {
+		out, _ := json.Marshal(v)
+		var generic interface{}
+		_ = json.Unmarshal(out, &generic)
+		return generic
+	}
+	return reflect.DeepEqual(normalise(a), normalise(b))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// decodeTestJSON decodes s the way patchMovie decodes documents
+func decodeTestJSON(t *testing.T, s string) interface{} {
+	t.Helper()
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader([]byte(s)))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		t.Fatalf("%s: %v", s, err)
+	}
+	return v
+}
+
+// the examples of RFC 7396 appendix A
+func TestApplyMergePatch(t *testing.T) {
+	tests := []struct{ target, patch, want string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, tt := range tests {
+		got := applyMergePatch(decodeTestJSON(t, tt.target), decodeTestJSON(t, tt.patch))
+		if !jsonEqual(got, decodeTestJSON(t, tt.want)) {
+			out, _ := json.Marshal(got)
+			t.Errorf("%s patched with %s: got %s, want %s", tt.target, tt.patch, out, tt.want)
+		}
+	}
+}
+
+// examples from RFC 6902 appendix A
+func TestApplyJSONPatch(t *testing.T) {
+	tests := []struct{ doc, patch, want string }{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+		{`{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10}]`, `{"/":9,"~1":10}`},
+		{`{"foo":"bar"}`, `[{"op":"copy","from":"/foo","path":"/baz"}]`, `{"baz":"bar","foo":"bar"}`},
+		{`{"baz":"qux","foo":["a",2,"c"]}`,
+			`[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+			`{"baz":"qux","foo":["a",2,"c"]}`},
+	}
+	for _, tt := range tests {
+		var ops []jsonPatchOperation
+		if err := json.Unmarshal([]byte(tt.patch), &ops); err != nil {
+			t.Fatal(err)
+		}
+		got, err := applyJSONPatch(decodeTestJSON(t, tt.doc), ops)
+		if err != nil {
+			t.Errorf("%s patched with %s: %v", tt.doc, tt.patch, err)
+			continue
+		}
+		if !jsonEqual(got, decodeTestJSON(t, tt.want)) {
+			out, _ := json.Marshal(got)
+			t.Errorf("%s patched with %s: got %s, want %s", tt.doc, tt.patch, out, tt.want)
+		}
+	}
+}
+
+func TestApplyJSONPatchErrors(t *testing.T) {
+	tests := []struct{ doc, patch string }{
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/5","value":"qux"}]`},
+		{`{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`},
+		{`{"foo":"bar"}`, `[{"op":"frobnicate","path":"/foo"}]`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"foo","value":1}]`},
+		// the second operation fails, so the first one doesn't count either
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":1},{"op":"remove","path":"/nope"}]`},
+	}
+	for _, tt := range tests {
+		var ops []jsonPatchOperation
+		if err := json.Unmarshal([]byte(tt.patch), &ops); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := applyJSONPatch(decodeTestJSON(t, tt.doc), ops); err == nil {
+			out, _ := json.Marshal(got)
+			t.Errorf("%s patched with %s: got %s, want an error", tt.doc, tt.patch, out)
+		}
+	}
+}
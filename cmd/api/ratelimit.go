@@ -0,0 +1,324 @@
+package main
+
+import (
+	"backend/internals/models"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// where the rate limiter keeps its buckets
+const (
+	// in the memory of this process. every instance counts on its own
+	rateLimitStoreMemory = "memory"
+	// in Postgres, shared by every instance behind the load balancer
+	rateLimitStorePostgres = "postgres"
+)
+
+// how often we forget the buckets and failed logins nobody needs any more
+const rateLimitSweepInterval = time.Minute
+
+var errTooManyRequests = errors.New("too many requests, slow down")
+
+// rateLimit is a token bucket: a client can make Requests requests right
+// away, and gets them back one by one over Period. zero Requests is no
+// limit at all
+type rateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+func (l rateLimit) enabled() bool {
+	return l.Requests > 0 && l.Period > 0
+}
+
+// what taking a token from a bucket came to
+type rateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// how long until there's a token again, when there wasn't one
+	RetryAfter time.Duration
+}
+
+// take refills the bucket for the time that passed since it was last
+// used and takes a token out of it, if there is one
+func (l rateLimit) take(bucket *models.RateLimitBucket, now time.Time) rateLimitResult {
+	capacity := float64(l.Requests)
+	perSecond := capacity / l.Period.Seconds()
+
+	if bucket.UpdatedAt.IsZero() {
+		bucket.Tokens = capacity
+	} else if elapsed := now.Sub(bucket.UpdatedAt); elapsed > 0 {
+		bucket.Tokens = math.Min(capacity, bucket.Tokens+elapsed.Seconds()*perSecond)
+	}
+	bucket.UpdatedAt = now
+
+	if bucket.Tokens < 1 {
+		wait := (1 - bucket.Tokens) / perSecond
+		return rateLimitResult{RetryAfter: time.Duration(wait * float64(time.Second))}
+	}
+	bucket.Tokens--
+	return rateLimitResult{Allowed: true, Remaining: int(bucket.Tokens)}
+}
+
+// rateLimitStore keeps the buckets and the failed logins. the updates
+// run with whatever they update locked, so concurrent requests (on other
+// instances too, for Postgres) can't both take the last token
+type rateLimitStore interface {
+	UpdateBucket(ctx context.Context, key string, update func(bucket *models.RateLimitBucket) error) error
+	LoginFailures(ctx context.Context, key string) (*models.LoginFailures, error)
+	UpdateLoginFailures(ctx context.Context, key string, update func(failures *models.LoginFailures) error) error
+	ClearLoginFailures(ctx context.Context, key string) error
+	// Purge forgets buckets untouched since bucketsBefore (they're full
+	// again by then) and failures whose last failure and lock both ended
+	// before failuresBefore
+	Purge(ctx context.Context, bucketsBefore, failuresBefore time.Time) error
+}
+
+// memoryRateLimitStore keeps everything in maps
+type memoryRateLimitStore struct {
+	mu       sync.Mutex
+	buckets  map[string]models.RateLimitBucket
+	failures map[string]models.LoginFailures
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{
+		buckets:  make(map[string]models.RateLimitBucket),
+		failures: make(map[string]models.LoginFailures),
+	}
+}
+
+func (s *memoryRateLimitStore) UpdateBucket(_ context.Context, key string, update func(bucket *models.RateLimitBucket) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = models.RateLimitBucket{Key: key}
+	}
+	if err := update(&bucket); err != nil {
+		return err
+	}
+	s.buckets[key] = bucket
+	return nil
+}
+
+func (s *memoryRateLimitStore) LoginFailures(_ context.Context, key string) (*models.LoginFailures, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	failures, ok := s.failures[key]
+	if !ok {
+		failures = models.LoginFailures{Key: key}
+	}
+	return &failures, nil
+}
+
+func (s *memoryRateLimitStore) UpdateLoginFailures(_ context.Context, key string, update func(failures *models.LoginFailures) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	failures, ok := s.failures[key]
+	if !ok {
+		failures = models.LoginFailures{Key: key}
+	}
+	if err := update(&failures); err != nil {
+		return err
+	}
+	s.failures[key] = failures
+	return nil
+}
+
+func (s *memoryRateLimitStore) ClearLoginFailures(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.failures, key)
+	return nil
+}
+
+func (s *memoryRateLimitStore) Purge(_ context.Context, bucketsBefore, failuresBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, bucket := range s.buckets {
+		if bucket.UpdatedAt.Before(bucketsBefore) {
+			delete(s.buckets, key)
+		}
+	}
+	for key, failures := range s.failures {
+		if failures.LastFailureAt.Before(failuresBefore) && failures.LockedUntil.Before(failuresBefore) {
+			delete(s.failures, key)
+		}
+	}
+	return nil
+}
+
+// dbRateLimitStore keeps everything in Postgres, through the repository
+type dbRateLimitStore struct {
+	app *application
+}
+
+func (s dbRateLimitStore) UpdateBucket(ctx context.Context, key string, update func(bucket *models.RateLimitBucket) error) error {
+	return s.app.DB.WithContext(ctx).UpdateRateLimitBucket(key, update)
+}
+
+func (s dbRateLimitStore) LoginFailures(ctx context.Context, key string) (*models.LoginFailures, error) {
+	return s.app.DB.WithContext(ctx).GetLoginFailures(key)
+}
+
+func (s dbRateLimitStore) UpdateLoginFailures(ctx context.Context, key string, update func(failures *models.LoginFailures) error) error {
+	return s.app.DB.WithContext(ctx).UpdateLoginFailures(key, update)
+}
+
+func (s dbRateLimitStore) ClearLoginFailures(ctx context.Context, key string) error {
+	return s.app.DB.WithContext(ctx).DeleteLoginFailures(key)
+}
+
+func (s dbRateLimitStore) Purge(ctx context.Context, bucketsBefore, failuresBefore time.Time) error {
+	return s.app.DB.WithContext(ctx).PurgeRateLimits(bucketsBefore, failuresBefore)
+}
+
+// takeToken takes a token from the bucket of key
+func (app *application) takeToken(ctx context.Context, key string, limit rateLimit) (rateLimitResult, error) {
+	var result rateLimitResult
+	err := app.rateLimits.UpdateBucket(ctx, key, func(bucket *models.RateLimitBucket) error {
+		result = limit.take(bucket, time.Now())
+		return nil
+	})
+	return result, err
+}
+
+// rateLimited limits how often a client (an IP address) can call each
+// route. routes tells us which route a request is for before it's routed,
+// so /movies/1 and /movies/2 share a bucket. without routes a client has
+// one bucket for everything the limit is put on. name keeps the buckets
+// of different limits apart
+func (app *application) rateLimited(name string, limit rateLimit, routes chi.Routes) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !limit.enabled() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := name + "|" + app.clientIP(r)
+			if routes != nil {
+				rctx := chi.NewRouteContext()
+				if !routes.Match(rctx, r.Method, r.URL.Path) {
+					// it's going to be a 404 or 405 anyway, no point
+					// keeping a bucket for every path somebody makes up
+					next.ServeHTTP(w, r)
+					return
+				}
+				// /v1/movies/{id} and the old /movies/{id} are the same
+				// route, switching between them mustn't give a client a
+				// second bucket
+				pattern := unversionedPath(rctx.RoutePattern(), apiVersionFromContext(r.Context()))
+				key += "|" + r.Method + " " + pattern
+			}
+
+			result, err := app.takeToken(r.Context(), key, limit)
+			if err != nil {
+				// we'd rather let a few requests too many through than
+				// turn everybody away because the store is down
+				slog.WarnContext(r.Context(), "rate limiter failed, letting the request through", "err", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Requests))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			if !result.Allowed {
+				rateLimitedRequests.WithLabelValues(name).Inc()
+				app.tooManyRequests(w, errTooManyRequests, result.RetryAfter)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// tooManyRequests answers 429 and tells the client how long to wait
+// before trying again, in whole seconds and never less than one
+func (app *application) tooManyRequests(w http.ResponseWriter, err error, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	_ = app.errorJSON(w, err, http.StatusTooManyRequests)
+}
+
+// clientIP is the address a request came from. behind a proxy that's the
+// proxy, so when we're told to trust it we take the address it put at the
+// end of X-Forwarded-For instead. the entries before it are whatever the
+// client sent, anybody can make those up
+func (app *application) clientIP(r *http.Request) string {
+	if app.TrustForwardedFor {
+		forwarded := r.Header.Values("X-Forwarded-For")
+		if len(forwarded) > 0 {
+			hops := strings.Split(forwarded[len(forwarded)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); net.ParseIP(ip) != nil {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// sweepRateLimits runs in the background until ctx is cancelled, and
+// every so often forgets the buckets and failed logins that don't matter
+// any more
+func (app *application) sweepRateLimits(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		// a bucket is full again once its longest period has passed
+		period := app.RateLimit.Period
+		if app.AuthRateLimit.Period > period {
+			period = app.AuthRateLimit.Period
+		}
+		now := time.Now()
+		err := app.rateLimits.Purge(ctx, now.Add(-period), now.Add(-app.lockout.Window))
+		// when we're shutting down, a sweep cut short isn't worth a word
+		if err != nil && ctx.Err() == nil {
+			slog.Error("failed to sweep the rate limits", "err", err)
+		}
+		app.workerRan("rate-limit-sweep")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// newRateLimitStore is the store kind names
+func (app *application) newRateLimitStore(kind string) (rateLimitStore, error) {
+	switch kind {
+	case rateLimitStoreMemory:
+		return newMemoryRateLimitStore(), nil
+	case rateLimitStorePostgres:
+		return dbRateLimitStore{app: app}, nil
+	}
+	return nil, fmt.Errorf("unknown rate-limit-store %q (memory|postgres)", kind)
+}
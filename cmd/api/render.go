@@ -0,0 +1,521 @@
+package main
+
+import (
+	"backend/internals/models"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// a renderer writes values in one particular format
+type renderer interface {
+	ContentType() string
+	// the file extension, also the name of the format in ?format=
+	Extension() string
+	// NewEncoder starts a document on w. with list it's a list of items
+	// called name, of type item (the formats with a header need to know
+	// the fields before the first one), without it the document is the
+	// one item
+	NewEncoder(w io.Writer, name string, list bool, item reflect.Type) itemEncoder
+}
+
+// an itemEncoder writes a document an item at a time, so a list as big as
+// the whole catalog can be streamed. Close finishes the document
+type itemEncoder interface {
+	Encode(item interface{}) error
+	Close() error
+}
+
+// the formats we can produce, in the order we prefer them. the first
+// one is what you get when the client doesn't care
+var renderers = []renderer{
+	jsonRenderer{},
+	csvRenderer{},
+	xmlRenderer{},
+	ndjsonRenderer{},
+}
+
+// render works out from the Accept header which format the client wants
+// and writes data in it. name is what one item is called ("movie"), XML
+// uses it for element names. NDJSON only makes sense for lists, so for a
+// single item it isn't on offer. when we can't produce anything the
+// client accepts we send 406 Not Acceptable
+func (app *application) render(w http.ResponseWriter, r *http.Request, status int, name string, data interface{}) error {
+	// the response depends on the Accept header, caches need to know that
+	w.Header().Add("Vary", "Accept")
+
+	isList := reflect.Indirect(reflect.ValueOf(data)).Kind() == reflect.Slice
+
+	var offers []string
+	for _, rd := range renderers {
+		if _, ok := rd.(ndjsonRenderer); ok && !isList {
+			continue
+		}
+		offers = append(offers, mediaType(rd.ContentType()))
+	}
+
+	chosen, ok := negotiate(r.Header.Get("Accept"), offers)
+	if !ok {
+		return app.errorJSON(w, fmt.Errorf("not acceptable, we can send %s", strings.Join(offers, ", ")), http.StatusNotAcceptable)
+	}
+
+	var rd renderer
+	for _, candidate := range renderers {
+		if mediaType(candidate.ContentType()) == chosen {
+			rd = candidate
+			break
+		}
+	}
+
+	// render into a buffer first, so if something goes wrong we can
+	// still send a proper error instead of half a document
+	var buf bytes.Buffer
+	if err := encodeAll(rd, &buf, name, data); err != nil {
+		return app.errorJSON(w, err, http.StatusInternalServerError)
+	}
+
+	w.Header().Set("Content-Type", rd.ContentType())
+
+	// handlers can set a better ETag themselves (the one of the JSON),
+	// otherwise we use a hash of the content. either way a client that
+	// already has this version gets a 304 instead of the whole thing again
+	if status == http.StatusOK {
+		if etag := w.Header().Get("ETag"); etag == "" {
+			w.Header().Set("ETag", contentETag(buf.Bytes()))
+		} else {
+			w.Header().Set("ETag", representationETag(etag, rd.ContentType()))
+		}
+		if notModified(w, r) {
+			writeNotModified(w)
+			return nil
+		}
+	}
+
+	w.WriteHeader(status)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// encodeAll writes data, a list or a single item, in the format of rd
+func encodeAll(rd renderer, w io.Writer, name string, data interface{}) error {
+	v := reflect.Indirect(reflect.ValueOf(data))
+	if v.Kind() != reflect.Slice {
+		enc := rd.NewEncoder(w, name, false, reflect.TypeOf(data))
+		if err := enc.Encode(data); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+
+	enc := rd.NewEncoder(w, name, true, v.Type().Elem())
+	for i := 0; i < v.Len(); i++ {
+		if err := enc.Encode(v.Index(i).Interface()); err != nil {
+			return err
+		}
+	}
+	return enc.Close()
+}
+
+// mediaType strips the parameters off a content type,
+// "text/csv; charset=utf-8" becomes "text/csv"
+func mediaType(contentType string) string {
+	return strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+}
+
+// negotiate picks the offer the client likes best according to the Accept
+// header (RFC 9110 section 12.5.1). when two offers are liked the same we
+// take the one that comes first in offers. an empty header accepts anything
+func negotiate(accept string, offers []string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0], true
+	}
+
+	type acceptRange struct {
+		typ, subtype string
+		q            float64
+	}
+	var ranges []acceptRange
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		typ, subtype, _ := strings.Cut(strings.ToLower(strings.TrimSpace(params[0])), "/")
+		if typ == "" || subtype == "" {
+			continue
+		}
+		ar := acceptRange{typ: typ, subtype: subtype, q: 1}
+		for _, p := range params[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if strings.EqualFold(key, "q") {
+				if q, err := strconv.ParseFloat(value, 64); err == nil {
+					ar.q = q
+				}
+			}
+		}
+		ranges = append(ranges, ar)
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		typ, subtype, _ := strings.Cut(offer, "/")
+
+		// the most specific range that matches decides the quality,
+		// so "text/*;q=0.5, text/csv" gives text/csv a q of 1
+		q, specificity := 0.0, -1
+		for _, ar := range ranges {
+			s := -1
+			switch {
+			case ar.typ == typ && ar.subtype == subtype:
+				s = 2
+			case ar.typ == typ && ar.subtype == "*":
+				s = 1
+			case ar.typ == "*" && ar.subtype == "*":
+				s = 0
+			}
+			if s > specificity {
+				q, specificity = ar.q, s
+			}
+		}
+
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+
+	return best, bestQ > 0
+}
+
+type jsonRenderer struct{}
+
+func (jsonRenderer) ContentType() string { return "application/json" }
+func (jsonRenderer) Extension() string   { return "json" }
+
+func (jsonRenderer) NewEncoder(w io.Writer, name string, list bool, item reflect.Type) itemEncoder {
+	return &jsonEncoder{w: w, list: list}
+}
+
+// jsonEncoder writes a list as one JSON array, an item at a time
+type jsonEncoder struct {
+	w     io.Writer
+	list  bool
+	count int
+}
+
+func (j *jsonEncoder) Encode(item interface{}) error {
+	out, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	if j.list {
+		sep := ",\n"
+		if j.count == 0 {
+			sep = "["
+		}
+		if _, err := io.WriteString(j.w, sep); err != nil {
+			return err
+		}
+	}
+	j.count++
+	_, err = j.w.Write(out)
+	return err
+}
+
+func (j *jsonEncoder) Close() error {
+	if !j.list {
+		return nil
+	}
+	end := "]"
+	if j.count == 0 {
+		end = "[]"
+	}
+	_, err := io.WriteString(j.w, end)
+	return err
+}
+
+// ndjsonRenderer writes every item of a list as a JSON object on its own line
+type ndjsonRenderer struct{}
+
+func (ndjsonRenderer) ContentType() string { return "application/x-ndjson" }
+func (ndjsonRenderer) Extension() string   { return "ndjson" }
+
+// json.Encoder puts a newline after every value, which is exactly NDJSON
+func (ndjsonRenderer) NewEncoder(w io.Writer, name string, list bool, item reflect.Type) itemEncoder {
+	return ndjsonEncoder{json.NewEncoder(w)}
+}
+
+type ndjsonEncoder struct {
+	enc *json.Encoder
+}
+
+func (n ndjsonEncoder) Encode(item interface{}) error { return n.enc.Encode(item) }
+func (n ndjsonEncoder) Close() error                  { return nil }
+
+// the CSV and XML renderers go through JSON first, that way the column
+// and element names are exactly the names the JSON has, and fields we
+// hide from JSON (like "-") stay hidden
+func toGeneric(data interface{}) (interface{}, error) {
+	out, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var generic interface{}
+	dec := json.NewDecoder(bytes.NewReader(out))
+	dec.UseNumber() // keep 7 as 7 instead of 7e+00
+	err = dec.Decode(&generic)
+	return generic, err
+}
+
+// a movie has one CSV shape, whether it's one movie, a page of them or
+// the whole catalog from /admin/export: the flat record the import reads
+var (
+	movieType    = reflect.TypeOf(models.Movie{})
+	moviePtrType = reflect.PointerTo(movieType)
+	movieCSVType = reflect.TypeOf(exportRecord{})
+)
+
+// csvItem is what item looks like in a CSV file
+func csvItem(item interface{}) interface{} {
+	switch movie := item.(type) {
+	case *models.Movie:
+		return newExportRecord(movie)
+	case models.Movie:
+		return newExportRecord(&movie)
+	}
+	return item
+}
+
+// csvRenderer writes one row per item with a header row. the columns are
+// the fields of the item, in the order they're declared. a list of strings
+// goes into its cell separated by "|" (genres, the way the import takes
+// them), other nested values as JSON
+type csvRenderer struct{}
+
+func (csvRenderer) ContentType() string { return "text/csv; charset=utf-8" }
+func (csvRenderer) Extension() string   { return "csv" }
+
+func (csvRenderer) NewEncoder(w io.Writer, name string, list bool, item reflect.Type) itemEncoder {
+	if item == movieType || item == moviePtrType {
+		item = movieCSVType
+	}
+	return &csvEncoder{w: csv.NewWriter(w), name: name, header: jsonFieldNames(item)}
+}
+
+type csvEncoder struct {
+	w    *csv.Writer
+	name string
+	// the columns, nil until we know them when the items aren't structs
+	header      []string
+	wroteHeader bool
+}
+
+func (c *csvEncoder) writeHeader(row map[string]interface{}) error {
+	if c.header == nil {
+		// not a struct, the keys of the first item will have to do
+		for key := range row {
+			c.header = append(c.header, key)
+		}
+		sort.Strings(c.header)
+	}
+	c.wroteHeader = true
+	return c.w.Write(c.header)
+}
+
+func (c *csvEncoder) Encode(item interface{}) error {
+	generic, err := toGeneric(csvItem(item))
+	if err != nil {
+		return err
+	}
+	row, ok := generic.(map[string]interface{})
+	if !ok {
+		row = map[string]interface{}{c.name: generic}
+	}
+
+	if !c.wroteHeader {
+		if err := c.writeHeader(row); err != nil {
+			return err
+		}
+	}
+	record := make([]string, len(c.header))
+	for i, column := range c.header {
+		record[i] = csvCell(row[column])
+	}
+	if err := c.w.Write(record); err != nil {
+		return err
+	}
+	// csv.Writer buffers, push it through so a stream can be flushed
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvEncoder) Close() error {
+	// an empty list still has its header, when we know it
+	if !c.wroteHeader && c.header != nil {
+		if err := c.writeHeader(nil); err != nil {
+			return err
+		}
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func csvCell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case []interface{}:
+		words := make([]string, 0, len(v))
+		for _, item := range v {
+			word, ok := item.(string)
+			if !ok {
+				out, _ := json.Marshal(v)
+				return string(out)
+			}
+			words = append(words, word)
+		}
+		return strings.Join(words, "|")
+	default:
+		out, _ := json.Marshal(v)
+		return string(out)
+	}
+}
+
+// jsonFieldNames returns the JSON names of the fields of a struct type,
+// in the order they're declared. t can be a pointer to one too
+func jsonFieldNames(t reflect.Type) []string {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		switch name {
+		case "-":
+			continue
+		case "":
+			name = field.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// xmlRenderer writes a list as <movies><movie>...</movie></movies> and
+// a single item as <movie>...</movie>
+type xmlRenderer struct{}
+
+func (xmlRenderer) ContentType() string { return "application/xml; charset=utf-8" }
+func (xmlRenderer) Extension() string   { return "xml" }
+
+func (xmlRenderer) NewEncoder(w io.Writer, name string, list bool, item reflect.Type) itemEncoder {
+	return &xmlEncoder{w: w, enc: xml.NewEncoder(w), name: name, list: list}
+}
+
+type xmlEncoder struct {
+	w       io.Writer
+	enc     *xml.Encoder
+	name    string
+	list    bool
+	started bool
+}
+
+// start writes the XML declaration, and opens the list
+func (x *xmlEncoder) start() error {
+	x.started = true
+	if _, err := io.WriteString(x.w, xml.Header); err != nil {
+		return err
+	}
+	if x.list {
+		return x.enc.EncodeToken(xml.StartElement{Name: xml.Name{Local: x.name + "s"}})
+	}
+	return nil
+}
+
+func (x *xmlEncoder) Encode(item interface{}) error {
+	generic, err := toGeneric(item)
+	if err != nil {
+		return err
+	}
+	if !x.started {
+		if err := x.start(); err != nil {
+			return err
+		}
+	}
+	if err := writeXMLElement(x.enc, x.name, x.name, generic); err != nil {
+		return err
+	}
+	return x.enc.Flush()
+}
+
+func (x *xmlEncoder) Close() error {
+	if !x.started {
+		if err := x.start(); err != nil {
+			return err
+		}
+	}
+	if x.list {
+		if err := x.enc.EncodeToken(xml.EndElement{Name: xml.Name{Local: x.name + "s"}}); err != nil {
+			return err
+		}
+	}
+	return x.enc.Flush()
+}
+
+// writeXMLElement writes value as an element called name. items of a list
+// are called itemName, and keys of an object become child elements
+func writeXMLElement(enc *xml.Encoder, name, itemName string, value interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			// a list inside an object is named after its key, "genres"
+			// holds "genre" elements
+			child := strings.TrimSuffix(key, "s")
+			if err := writeXMLElement(enc, key, child, v[key]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := writeXMLElement(enc, itemName, itemName, item); err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		if err := enc.EncodeToken(xml.CharData(csvCell(v))); err != nil {
+			return err
+		}
+	}
+
+	return enc.EncodeToken(start.End())
+}
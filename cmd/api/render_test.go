@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{"application/json", "text/csv", "application/xml", "application/x-ndjson"}
+
+	tests := []struct {
+		accept string
+		want   string
+		ok     bool
+	}{
+		{"", "application/json", true},
+		{"*/*", "application/json", true},
+		{"text/csv", "text/csv", true},
+		{"TEXT/CSV", "text/csv", true},
+		{"text/*", "text/csv", true},
+		{"application/xml;q=0.9, text/csv;q=0.5", "application/xml", true},
+		// the most specific range decides, text/csv keeps its q of 1
+		{"text/*;q=0.5, text/csv", "text/csv", true},
+		{"text/csv;q=0, */*", "application/json", true},
+		// equally liked, our order decides
+		{"text/csv, application/json", "application/json", true},
+		{"application/x-ndjson; charset=utf-8", "application/x-ndjson", true},
+		{"image/png", "", false},
+		{"text/csv;q=0", "", false},
+		{"garbage", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := negotiate(tt.accept, offers)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Accept %q: got %q, %v, want %q, %v", tt.accept, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -2,11 +2,22 @@ package main
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
 
+// when PUT /admin/movies/0 gave way to POST /admin/movies
+var createMovieDeprecatedSince = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+
+// the routes without a version in front of them are the same as /v1, they
+// stay around until the sunset date so clients have time to move over
+var (
+	unversionedDeprecatedSince = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+	unversionedSunset          = time.Date(2027, time.April, 19, 0, 0, 0, 0, time.UTC)
+)
+
 func (app *application) routes() http.Handler {
 	// create a router mux(multiplexer)
 	mux := chi.NewRouter()
@@ -16,6 +27,17 @@ func (app *application) routes() http.Handler {
 
 	//****************************************************
 	//********** Middlewares *****************************
+	// the span of the request is started before anything else, so the
+	// access log and every log line after it carry its trace id
+	mux.Use(traceRequests)
+	// give every request an id and log it once it's done. these come
+	// first so everything after them, panics included, is logged with
+	// the request id
+	mux.Use(requestID)
+	mux.Use(accessLog)
+	// count and time every request, outside the Recoverer so the
+	// requests that panicked are counted as the 500s they end up as
+	mux.Use(app.metrics)
 	// Recoverer : all this does is when your
 	// application panics for some reason , it will
 	// log it along with backtrace and showing you where
@@ -27,17 +49,77 @@ func (app *application) routes() http.Handler {
 	mux.Use(middleware.Recoverer)
 	mux.Use(app.enableCORS)
 
+	// for our orchestrator and Prometheus, these aren't part of any version of the API
+	mux.Get("/healthz", app.Healthz)
+	mux.Get("/readyz", app.Readyz)
+	mux.Method(http.MethodGet, "/metrics", app.Metrics())
+
+	// the rate limiter looks up which route a request is for in here
+	routes := mux
+
+	// every version of the API lives under its own prefix. when we need to
+	// make a breaking change we add a v2Routes that registers the v1 routes
+	// and then replaces the ones that change, and mount it here as /v2,
+	// so v1 clients keep working while they move over
+	mux.Route("/v1", func(mux chi.Router) {
+		mux.Use(apiVersion("v1"))
+		// every client gets app.RateLimit requests on each route. not on
+		// the ones above, our orchestrator and Prometheus call those all
+		// the time
+		mux.Use(app.rateLimited("api", app.RateLimit, routes))
+		app.v1Routes(mux)
+	})
+
+	// the same routes without the /v1, for the clients we had before
+	// versioning. every response tells them where to go instead
+	mux.Group(func(mux chi.Router) {
+		mux.Use(apiVersion("v1"))
+		// the same buckets as under /v1
+		mux.Use(app.rateLimited("api", app.RateLimit, routes))
+		mux.Use(deprecatedFor(unversionedDeprecatedSince, unversionedSunset, func(r *http.Request) string {
+			return "/v1" + r.URL.Path
+		}))
+		app.v1Routes(mux)
+	})
+
+	return mux
+}
+
+// v1Routes registers version 1 of the API
+func (app *application) v1Routes(mux chi.Router) {
 	// anytime you get Get() request to "/" path
 	// go to the hander app.Home
 	mux.Get("/", app.Home)
 
-	mux.Post("/authenticate", app.authenticate) // b/c we're sending JSON file
+	// the OpenAPI description of everything below. every route added here
+	// has to be documented in openapi.json too, or TestRoutesAreDocumented fails
+	mux.Get("/openapi.json", app.OpenAPI)
+
+	// a tighter limit on guessing passwords, on top of the lockout of
+	// the account in authenticate
+	mux.With(app.rateLimited("auth", app.AuthRateLimit, nil)).Post("/authenticate", app.authenticate) // b/c we're sending JSON file
+	// the second step for users with two-factor authentication, the code
+	// from their app
+	mux.With(app.rateLimited("auth", app.AuthRateLimit, nil)).Post("/authenticate/mfa", app.authenticateMFA)
 
 	//get request by default will include the refresh token cookie if
 	// it exists in the user browser
 	mux.Get("/refresh", app.refreshToken)
 	mux.Get("/logout", app.logout)
 
+	// for users who forgot their password: we mail them a link, and the
+	// link lets them set a new one. limited like logging in, so nobody
+	// floods a user with emails
+	mux.With(app.rateLimited("password", app.AuthRateLimit, nil)).Post("/password/forgot", app.ForgotPassword)
+	mux.With(app.rateLimited("password", app.AuthRateLimit, nil)).Post("/password/reset", app.ResetPassword)
+
+	// proving an email address is yours, with the link we mailed. a user
+	// who lost the email asks for another one, which is throttled for
+	// each user in ResendVerification. the routes with app.verifiedRequired
+	// (after app.authRequired) need a verified address
+	mux.With(app.rateLimited("verify", app.AuthRateLimit, nil)).Get("/verify-email", app.VerifyEmail)
+	mux.With(app.authRequired).Post("/verify-email/resend", app.ResendVerification)
+
 	mux.Get("/movies", app.AllMovie)
 	mux.Get("/movies/{id}", app.GetMovie)
 
@@ -47,22 +129,84 @@ func (app *application) routes() http.Handler {
 	// we've just have one path to one handler and we'll use that for all
 	// of our GrapQL related requests
 	mux.Post("/graph", app.moviesGraphQL)
+	// APQ clients can send persisted queries as a GET, so they can be cached
+	mux.Get("/graph", app.moviesGraphQL)
 	//******************************************
 	//******** Routes **************************
 
+	// the account of the logged in user. the routes taking the password
+	// are limited like logging in
+	mux.Route("/me", func(mux chi.Router) {
+		mux.Use(app.authRequired)
+
+		mux.Get("/", app.GetMe)
+		mux.Patch("/", app.UpdateMe)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.rateLimited("account", app.AuthRateLimit, nil))
+			mux.Post("/password", app.ChangeMyPassword)
+			mux.Delete("/", app.DeleteMe)
+		})
+	})
+
+	// setting up two-factor authentication. the routes taking a code are
+	// limited like logging in
+	mux.Route("/mfa", func(mux chi.Router) {
+		mux.Use(app.authRequired)
+
+		mux.Get("/", app.MFAStatus)
+		mux.Post("/totp/enroll", app.EnrollTOTP)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.rateLimited("mfa", app.AuthRateLimit, nil))
+			mux.Post("/totp/confirm", app.ConfirmTOTP)
+			mux.Post("/totp/disable", app.DisableTOTP)
+			mux.Post("/recovery-codes", app.RegenerateRecoveryCodes)
+		})
+	})
+
 	mux.Route("/admin", func(mux chi.Router) {
 		// jwt validation middleware
 		mux.Use(app.authRequired)
+		// only for admins, who need a second factor when
+		// app.RequireAdminMFA says so. what they write everybody sees,
+		// so they need a verified email address too
+		mux.Use(app.adminRequired)
+		mux.Use(app.mfaRequired)
+		mux.Use(app.verifiedRequired)
 
 		// protected routes
 		mux.Get("/movies", app.MovieCatalog) // real route is "/admin/movies" but "/admin" part is not required
 		mux.Get("/movies/{id}", app.MovieForEdit)
 
-		mux.Put("/movies/0", app.InsertMovie)      // insert a new movie
-		mux.Patch("/movies/{id}", app.UpdateMovie) // update an existing movie
+		// insert a new movie, retries with the same Idempotency-Key
+		// won't create it twice
+		mux.With(app.idempotent).Post("/movies", app.CreateMovie)
+		// the old way to insert a movie, still works but is deprecated
+		mux.With(deprecated(createMovieDeprecatedSince, time.Time{}, "/v1/admin/movies")).Put("/movies/0", app.InsertMovie)
+		mux.Post("/movies/bulk", app.BulkImportMovies) // many movies from a CSV or NDJSON file
+		mux.Patch("/movies/{id}", app.UpdateMovie)     // update an existing movie
 
 		// delete a movie
 		mux.Delete("/movies/{id}", app.DeleteMovie)
+
+		// who changed a movie and how, and undoing those changes
+		mux.Get("/movies/{id}/history", app.MovieHistory)
+		mux.Post("/movies/{id}/history/{revision}/restore", app.RestoreMovieRevision)
+
+		// the whole catalog as a CSV, NDJSON or JSON file
+		mux.Get("/export", app.ExportMovies)
+
+		// deleted movies stay in the trash until they're restored or purged
+		mux.Get("/trash", app.Trash)
+		mux.Post("/trash/{id}/restore", app.RestoreFromTrash)
+		mux.Delete("/trash/{id}", app.PurgeMovie)
+
+		// managing the accounts of users
+		mux.Get("/users", app.ListUsers)
+		mux.Post("/users", app.CreateUser)
+		mux.Get("/users/{id}", app.GetUser)
+		mux.Post("/users/{id}/disable", app.DisableUser)
+		mux.Post("/users/{id}/enable", app.EnableUser)
+		mux.Post("/users/{id}/logout", app.LogoutUser)
+		mux.Put("/users/{id}/role", app.SetUserRole)
 	})
-	return mux
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// serve runs the web server until ctx is cancelled (we got SIGINT or
+// SIGTERM), then shuts down gracefully: we stop accepting connections,
+// give the requests we're in the middle of and the background workers
+// until ShutdownTimeout to finish, and close the database pool
+func (app *application) serve(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", app.Port),
+		Handler: app.routes(),
+		// without these a client that sends its request (or reads our
+		// response) very slowly can hold a connection open forever
+		ReadHeaderTimeout: app.ReadHeaderTimeout,
+		ReadTimeout:       app.ReadTimeout,
+		WriteTimeout:      app.WriteTimeout,
+		IdleTimeout:       app.IdleTimeout,
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("starting application", "version", version, "env", app.Env, "port", app.Port)
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		// unable to start the server (or it died on us)
+		app.waitForWorkers(time.Now().Add(app.ShutdownTimeout))
+		app.DB.Connection().Close()
+		return err
+	case <-ctx.Done():
+	}
+
+	// tell the load balancer to stop sending us traffic while we finish
+	app.shuttingDown.Store(true)
+
+	slog.Info("shutting down, waiting for requests to finish", "timeout", app.ShutdownTimeout)
+	deadline := time.Now().Add(app.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	// Shutdown closes the listeners and then waits for every connection
+	// to go idle. when the deadline passes we close whatever is left
+	err := srv.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Warn("requests still running at the deadline, closing them", "err", err)
+		srv.Close()
+	}
+	if err := <-serverErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("server failed", "err", err)
+	}
+
+	// the workers saw ctx was cancelled too, they finish what they're
+	// doing and stop
+	app.waitForWorkers(deadline)
+
+	// send off the spans still waiting in the batch
+	if err := app.shutdownTracing(shutdownCtx); err != nil {
+		slog.Warn("failed to flush the traces", "err", err)
+	}
+
+	// only now nobody is using the database any more
+	if err := app.DB.Connection().Close(); err != nil {
+		return err
+	}
+	slog.Info("stopped")
+	return nil
+}
+
+// startWorker runs fn in the background. fn must return soon after ctx is
+// cancelled, so we can wait for it when we shut down. the name is how
+// /readyz reports on it
+func (app *application) startWorker(ctx context.Context, name string, fn func(ctx context.Context)) {
+	app.setWorkerRunning(name, true)
+	app.workers.Add(1)
+	go func() {
+		defer app.workers.Done()
+		defer app.setWorkerRunning(name, false)
+		fn(ctx)
+	}()
+}
+
+// background runs fn in a goroutine that we wait for when we shut down,
+// for work a request starts but doesn't wait for (like sending an email)
+func (app *application) background(fn func()) {
+	app.workers.Add(1)
+	go func() {
+		defer app.workers.Done()
+		defer func() {
+			if err := recover(); err != nil {
+				slog.Error("background job panicked", "err", err)
+			}
+		}()
+		fn()
+	}()
+}
+
+// waitForWorkers waits for the background workers to stop, but not past
+// the deadline
+func (app *application) waitForWorkers(deadline time.Time) {
+	done := make(chan struct{})
+	go func() {
+		app.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline)):
+		slog.Warn("background workers still running at the deadline")
+	}
+}
+
+// extendDeadlines gives a request that's known to be slow (a big import or
+// export) longer than the server's ReadTimeout and WriteTimeout. a zero
+// duration leaves that deadline alone
+func extendDeadlines(w http.ResponseWriter, read, write time.Duration) {
+	rc := http.NewResponseController(w)
+	if read > 0 {
+		if err := rc.SetReadDeadline(time.Now().Add(read)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			slog.Warn("failed to extend the read deadline", "err", err)
+		}
+	}
+	if write > 0 {
+		if err := rc.SetWriteDeadline(time.Now().Add(write)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			slog.Warn("failed to extend the write deadline", "err", err)
+		}
+	}
+}
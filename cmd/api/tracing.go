@@ -0,0 +1,196 @@
+package main
+
+import (
+	"backend/internals/logging"
+	"backend/internals/tracing"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// where the spans go
+const (
+	// nowhere, tracing is off (the spans are still started, they just
+	// aren't recorded, which costs next to nothing)
+	traceExporterNone = "none"
+	// pretty printed to stdout, handy while working on something
+	traceExporterStdout = "stdout"
+	// OTLP/JSON lines appended to trace-file
+	traceExporterFile = "file"
+)
+
+const serviceName = "movies-api"
+
+// the tracer everything in this package starts its spans with
+var tracer = otel.Tracer("backend/cmd/api")
+
+// setupTracing installs the global tracer provider and the W3C trace
+// context propagator. the function it returns flushes the spans that are
+// still buffered, call it when shutting down
+func (app *application) setupTracing() (func(context.Context) error, error) {
+	// we pick up a traceparent (and baggage) sent by whoever called us, and
+	// send ours on to TMDB, so our spans join their trace
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch app.TraceExporter {
+	case traceExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case traceExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+	case traceExporterFile:
+		exporter, err = otlptrace.New(context.Background(), &tracing.FileClient{Path: app.TraceFile})
+	default:
+		return nil, fmt.Errorf("unknown trace-exporter %q (none|stdout|file)", app.TraceExporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(version),
+		semconv.DeploymentEnvironment(app.Env),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// a caller that already decided whether to sample a trace gets
+		// its way, the rest are sampled at trace-sample-ratio
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(app.TraceSampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// traceRequests starts a span for every request, continuing the trace of
+// the traceparent header if there is one
+func traceRequests(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(traceRoute(next), "http.server",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method
+		}),
+		// /metrics and the health checks are probed every few seconds,
+		// tracing them only buries the requests we care about
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			switch r.URL.Path {
+			case "/metrics", "/healthz", "/readyz":
+				return false
+			}
+			return true
+		}),
+	)
+}
+
+// traceRoute names the request span after the route chi matched, the way
+// the metrics label requests, "GET /v1/movies/{id}"
+func traceRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+
+		rctx := chi.RouteContext(r.Context())
+		if rctx == nil || rctx.RoutePattern() == "" {
+			return
+		}
+		span := trace.SpanFromContext(r.Context())
+		span.SetName(r.Method + " " + rctx.RoutePattern())
+		span.SetAttributes(semconv.HTTPRoute(rctx.RoutePattern()))
+	})
+}
+
+// traceQuery starts a span for a repository call. every method runs one
+// statement, so the method name is the name of the statement too
+func traceQuery(ctx context.Context, method string) (context.Context, func(err error)) {
+	ctx, span := tracer.Start(ctx, "db."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBOperationName(method),
+		),
+	)
+	return ctx, func(err error) {
+		// not finding a row is an answer, not a failure
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// observeRepo is what the repository calls for every query: it gets a
+// span and ends up in /metrics
+func observeRepo(ctx context.Context, method string) (context.Context, func(err error)) {
+	ctx, endSpan := traceQuery(ctx, method)
+	ctx, record := observeQuery(ctx, method)
+	return ctx, func(err error) {
+		record(err)
+		endSpan(err)
+	}
+}
+
+// tracedTransport sends our trace context on to the servers we call and
+// gives every outgoing request a span of its own. we don't use the
+// otelhttp transport for this, it puts the whole URL on the span and the
+// TMDB api key is in the query string
+type tracedTransport struct {
+	base http.RoundTripper
+}
+
+func (t tracedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	ctx, span := tracer.Start(req.Context(), req.Method+" "+req.URL.Host,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.ServerAddress(req.URL.Hostname()),
+			semconv.URLPath(req.URL.Path),
+		),
+	)
+	defer span.End()
+
+	// RoundTrip mustn't change the request it was given
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		// the error can quote the URL, and with it the api key
+		msg := logging.Redact(err.Error())
+		span.RecordError(errors.New(msg))
+		span.SetStatus(codes.Error, msg)
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return resp, nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"backend/internals/models"
+	"backend/internals/repository"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var (
+	errAccountDisabled = errors.New("your account is disabled")
+	errAdminRequired   = errors.New("only admins can do that")
+	errUserNotFound    = errors.New("user not found")
+	errNotYourself     = errors.New("you can't do that to your own account")
+	// the only way out is POST /me/password
+	errPasswordChangeRequired = errors.New("change your temporary password first")
+)
+
+const (
+	// how many users a page of /admin/users has when the client doesn't say
+	defaultUserPageSize = 50
+	// and the most it can ask for
+	maxUserPageSize = 200
+	// how long a temporary password is, at least
+	temporaryPasswordLength = 24
+)
+
+// validRole tells whether role is one a user can have
+func validRole(role string) bool {
+	return role == roleUser || role == roleAdmin
+}
+
+// newTemporaryPassword makes up a password for a user an admin creates,
+// long enough for the password policy
+func (app *application) newTemporaryPassword() (string, error) {
+	n := max(temporaryPasswordLength, app.passwordPolicy.MinLength)
+	b := make([]byte, n*3/4+1)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b)[:n], nil
+}
+
+// userFromURL is the user the {id} in the path is for. when it isn't
+// there, it answers the request and gives back nil
+func (app *application) userFromURL(w http.ResponseWriter, r *http.Request) *models.User {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, errUserNotFound, http.StatusNotFound)
+		return nil
+	}
+	user, err := app.db(r).GetUserByID(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errUserNotFound, http.StatusNotFound)
+			return nil
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return nil
+	}
+	return user
+}
+
+// isRequestUser tells whether user is the one making the request
+func isRequestUser(r *http.Request, user *models.User) bool {
+	claims := claimsFromContext(r.Context())
+	return claims != nil && claims.Subject == strconv.Itoa(user.ID)
+}
+
+// path: GET /admin/users?q=&role=&disabled=&first=&after=
+// the users in the order they signed up, a page at a time. q looks in the
+// names and email addresses. the next page starts after the id in
+// next_after
+func (app *application) ListUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var problems []string
+
+	page := models.UserPageRequest{
+		Filter: models.UserFilter{
+			Query: strings.TrimSpace(query.Get("q")),
+			Role:  query.Get("role"),
+		},
+		First: defaultUserPageSize,
+	}
+	if page.Filter.Role != "" && !validRole(page.Filter.Role) {
+		problems = append(problems, fmt.Sprintf("role must be %s or %s", roleUser, roleAdmin))
+	}
+	if s := query.Get("disabled"); s != "" {
+		disabled, err := strconv.ParseBool(s)
+		if err != nil {
+			problems = append(problems, "disabled must be true or false")
+		} else {
+			page.Filter.Disabled = &disabled
+		}
+	}
+	if s := query.Get("first"); s != "" {
+		first, err := strconv.Atoi(s)
+		if err != nil || first < 1 || first > maxUserPageSize {
+			problems = append(problems, fmt.Sprintf("first must be between 1 and %d", maxUserPageSize))
+		} else {
+			page.First = first
+		}
+	}
+	if s := query.Get("after"); s != "" {
+		after, err := strconv.Atoi(s)
+		if err != nil || after < 0 {
+			problems = append(problems, "after must be a user id")
+		} else {
+			page.After = after
+		}
+	}
+	if len(problems) > 0 {
+		app.errorJSON(w, errors.New(strings.Join(problems, ", ")), http.StatusUnprocessableEntity)
+		return
+	}
+
+	result, err := app.db(r).ListUsers(page)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		Users     []*models.User `json:"users"`
+		NextAfter *int           `json:"next_after"`
+	}{Users: result.Users}
+	if resp.Users == nil {
+		resp.Users = []*models.User{}
+	}
+	if result.HasNextPage {
+		resp.NextAfter = &result.Users[len(result.Users)-1].ID
+	}
+	_ = app.writeJSON(w, http.StatusOK, resp)
+}
+
+// path: GET /admin/users/{id}
+func (app *application) GetUser(w http.ResponseWriter, r *http.Request) {
+	user := app.userFromURL(w, r)
+	if user == nil {
+		return
+	}
+	_ = app.writeJSON(w, http.StatusOK, user)
+}
+
+// path: POST /admin/users
+// creates an account with a temporary password, which is in the response
+// and nowhere else: the admin hands it over, the user has to change it.
+// we mail the user a link to verify their address
+func (app *application) CreateUser(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+		Email     string `json:"email"`
+		Role      string `json:"role"`
+	}
+	if err := app.readJSON(w, r, &payload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	now := time.Now()
+	user := models.User{
+		FirstName: strings.TrimSpace(payload.FirstName),
+		LastName:  strings.TrimSpace(payload.LastName),
+		Email:     strings.TrimSpace(payload.Email),
+		Role:      payload.Role,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if user.Role == "" {
+		user.Role = roleUser
+	}
+	problems := userProblems(user)
+	if !validRole(user.Role) {
+		problems = append(problems, fmt.Sprintf("role must be %s or %s", roleUser, roleAdmin))
+	}
+	if len(problems) > 0 {
+		app.errorJSON(w, errors.New(strings.Join(problems, ", ")), http.StatusUnprocessableEntity)
+		return
+	}
+
+	password, err := app.newTemporaryPassword()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	user.Password, err = hashPassword(password)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	id, err := app.db(r).CreateUser(user)
+	if err != nil {
+		if errors.Is(err, repository.ErrDuplicateEmail) {
+			app.errorJSON(w, err, http.StatusConflict)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	created, err := app.db(r).GetUserByID(id)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "user created", "user_id", created.ID, "role", created.Role)
+
+	ctx := context.WithoutCancel(r.Context())
+	app.background(func() {
+		if err := app.sendEmailVerification(ctx, created); err != nil {
+			slog.ErrorContext(ctx, "failed to send the email verification email", "user_id", created.ID, "err", err)
+		}
+	})
+
+	w.Header().Set("Location", fmt.Sprintf("/%s/admin/users/%d", apiVersionFromContext(r.Context()), created.ID))
+	_ = app.writeJSON(w, http.StatusCreated, struct {
+		User              *models.User `json:"user"`
+		TemporaryPassword string       `json:"temporary_password"`
+	}{created, password})
+}
+
+// path: POST /admin/users/{id}/disable
+// a disabled user can't log in, and is logged out everywhere. admins
+// can't disable themselves, or the last admin
+func (app *application) DisableUser(w http.ResponseWriter, r *http.Request) {
+	app.setUserDisabled(w, r, true)
+}
+
+// path: POST /admin/users/{id}/enable
+func (app *application) EnableUser(w http.ResponseWriter, r *http.Request) {
+	app.setUserDisabled(w, r, false)
+}
+
+func (app *application) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	user := app.userFromURL(w, r)
+	if user == nil {
+		return
+	}
+	if disabled && isRequestUser(r, user) {
+		app.errorJSON(w, errNotYourself, http.StatusConflict)
+		return
+	}
+
+	if err := app.db(r).SetUserDisabled(user.ID, disabled); err != nil {
+		switch {
+		case errors.Is(err, repository.ErrLastAdmin):
+			app.errorJSON(w, err, http.StatusConflict)
+		case errors.Is(err, sql.ErrNoRows):
+			app.errorJSON(w, errUserNotFound, http.StatusNotFound)
+		default:
+			app.errorJSON(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+	if disabled {
+		slog.InfoContext(r.Context(), "user disabled", "user_id", user.ID)
+	} else {
+		slog.InfoContext(r.Context(), "user enabled", "user_id", user.ID)
+	}
+
+	user, err := app.db(r).GetUserByID(user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	_ = app.writeJSON(w, http.StatusOK, user)
+}
+
+// path: POST /admin/users/{id}/logout
+// ends every session of the user, they have to log in again once their
+// access token runs out
+func (app *application) LogoutUser(w http.ResponseWriter, r *http.Request) {
+	user := app.userFromURL(w, r)
+	if user == nil {
+		return
+	}
+
+	if err := app.db(r).RevokeSessions(user.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errUserNotFound, http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "user logged out by an admin", "user_id", user.ID)
+
+	_ = app.writeJSON(w, http.StatusOK, JSONResponse{Message: "user logged out"})
+}
+
+// path: PUT /admin/users/{id}/role
+// makes the user an admin, or not. they're logged out so their tokens
+// carry the new role. admins can't change their own role, and there's
+// always an admin left
+func (app *application) SetUserRole(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Role string `json:"role"`
+	}
+	if err := app.readJSON(w, r, &payload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	if !validRole(payload.Role) {
+		app.errorJSON(w, fmt.Errorf("role must be %s or %s", roleUser, roleAdmin), http.StatusUnprocessableEntity)
+		return
+	}
+
+	user := app.userFromURL(w, r)
+	if user == nil {
+		return
+	}
+	if isRequestUser(r, user) {
+		app.errorJSON(w, errNotYourself, http.StatusConflict)
+		return
+	}
+
+	if err := app.db(r).SetUserRole(user.ID, payload.Role); err != nil {
+		switch {
+		case errors.Is(err, repository.ErrLastAdmin):
+			app.errorJSON(w, err, http.StatusConflict)
+		case errors.Is(err, sql.ErrNoRows):
+			app.errorJSON(w, errUserNotFound, http.StatusNotFound)
+		default:
+			app.errorJSON(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+	if user.Role != payload.Role {
+		slog.InfoContext(r.Context(), "user role changed", "user_id", user.ID, "from", user.Role, "to", payload.Role)
+	}
+
+	user, err := app.db(r).GetUserByID(user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	_ = app.writeJSON(w, http.StatusOK, user)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"backend/internals/mailer"
+	"backend/internals/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errEmailNotVerified   = errors.New("verify your email address first")
+	errInvalidVerifyToken = errors.New("the verification link is invalid or has expired, ask for a new one")
+	errAlreadyVerified    = errors.New("your email address is already verified")
+)
+
+// sendEmailVerification stores a new verification token for the address
+// user has now and mails it to them. whoever creates an account calls
+// this, and so does ResendVerification
+func (app *application) sendEmailVerification(ctx context.Context, user *models.User) error {
+	token, hash, err := newMailToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	err = app.DB.WithContext(ctx).CreateEmailVerification(models.EmailVerification{
+		TokenHash: hash,
+		UserID:    user.ID,
+		Email:     user.Email,
+		ExpiresAt: now.Add(app.EmailVerifyExpiry),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return err
+	}
+
+	link := strings.TrimSuffix(app.FrontendURL, "/") + "/verify-email?token=" + url.QueryEscape(token)
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Text: fmt.Sprintf("Hi %s,\n\n"+
+			"to let us know this address is yours, open this link in the next %s:\n\n"+
+			"%s\n\n"+
+			"If you didn't sign up, ignore this email.\n",
+			user.FirstName, inWords(app.EmailVerifyExpiry), link),
+	}
+	if err := app.mailer.Send(ctx, msg); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "sent an email verification email", "user_id", user.ID)
+	return nil
+}
+
+// path: GET /verify-email?token=
+// marks the address the token was mailed to as verified. the token works
+// once. the access tokens the user has still say they aren't verified,
+// /refresh gives them one that says they are
+func (app *application) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		app.errorJSON(w, errInvalidVerifyToken)
+		return
+	}
+
+	userID, err := app.db(r).VerifyEmail(hashMailToken(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errInvalidVerifyToken)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "email address verified", "user_id", userID)
+
+	_ = app.writeJSON(w, http.StatusOK, JSONResponse{Message: "email address verified"})
+}
+
+// path: POST /verify-email/resend
+// mails the logged in user a new verification link, the ones mailed
+// before stop working. a user only gets app.VerifyResendLimit of these
+func (app *application) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	claims := claimsFromContext(r.Context())
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		app.errorJSON(w, errors.New("unknown user"), http.StatusUnauthorized)
+		return
+	}
+	user, err := app.db(r).GetUserByID(userID)
+	if err != nil {
+		app.errorJSON(w, errors.New("unknown user"), http.StatusUnauthorized)
+		return
+	}
+	if user.EmailVerified() {
+		app.errorJSON(w, errAlreadyVerified, http.StatusConflict)
+		return
+	}
+
+	// counted per user rather than per address, so nobody can fill a
+	// mailbox by asking again and again from other machines
+	if app.VerifyResendLimit.enabled() {
+		result, err := app.takeToken(r.Context(), "verify-resend|"+claims.Subject, app.VerifyResendLimit)
+		if err != nil {
+			slog.WarnContext(r.Context(), "rate limiter failed, letting the request through", "err", err)
+		} else if !result.Allowed {
+			rateLimitedRequests.WithLabelValues("verify-resend").Inc()
+			app.tooManyRequests(w, errTooManyRequests, result.RetryAfter)
+			return
+		}
+	}
+
+	ctx := context.WithoutCancel(r.Context())
+	app.background(func() {
+		if err := app.sendEmailVerification(ctx, user); err != nil {
+			slog.ErrorContext(ctx, "failed to send the email verification email", "user_id", user.ID, "err", err)
+		}
+	})
+
+	_ = app.writeJSON(w, http.StatusAccepted, JSONResponse{Message: "a new verification link is on the way"})
+}
+
+// expireEmailVerifications forgets verification tokens that ran out a
+// day ago
+func (app *application) expireEmailVerifications() {
+	_, err := app.DB.DeleteEmailVerifications(time.Now().Add(-24 * time.Hour))
+	if err != nil {
+		slog.Error("failed to expire email verification tokens", "err", err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"backend/internals/models"
+)
+
+// what /readyz shows about a background worker
+type workerStatus struct {
+	Running bool       `json:"running"`
+	LastRun *time.Time `json:"last_run,omitempty"`
+}
+
+func (app *application) setWorkerRunning(name string, running bool) {
+	app.workersMu.Lock()
+	defer app.workersMu.Unlock()
+
+	if app.workerStatus == nil {
+		app.workerStatus = make(map[string]*workerStatus)
+	}
+	if app.workerStatus[name] == nil {
+		app.workerStatus[name] = &workerStatus{}
+	}
+	app.workerStatus[name].Running = running
+}
+
+// workerRan records that a worker just did its job
+func (app *application) workerRan(name string) {
+	app.workersMu.Lock()
+	defer app.workersMu.Unlock()
+
+	if status := app.workerStatus[name]; status != nil {
+		now := time.Now()
+		status.LastRun = &now
+	}
+}
+
+// workerStatuses is a copy of the state of every worker
+func (app *application) workerStatuses() map[string]workerStatus {
+	app.workersMu.Lock()
+	defer app.workersMu.Unlock()
+
+	out := make(map[string]workerStatus, len(app.workerStatus))
+	for name, status := range app.workerStatus {
+		out[name] = *status
+	}
+	return out
+}
+
+// how often we look for movies that have been in the trash long enough
+// (and for other things that have expired)
+const trashPurgeInterval = time.Hour
+
+// purgeTrash runs in the background until ctx is cancelled, and every so
+// often deletes for good the movies that have been in the trash for
+// longer than the retention period, expired idempotency keys, password
+// reset tokens and email verification tokens
+func (app *application) purgeTrash(ctx context.Context) {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		app.purgeOldTrash()
+		app.expireIdempotencyKeys()
+		app.expirePasswordResets()
+		app.expireEmailVerifications()
+		app.workerRan("trash-purge")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expireIdempotencyKeys forgets Idempotency-Keys we don't need to
+// remember any more
+func (app *application) expireIdempotencyKeys() {
+	_, err := app.DB.DeleteIdempotencyKeys(time.Now().Add(-idempotencyKeyTTL))
+	if err != nil {
+		slog.Error("failed to expire idempotency keys", "err", err)
+	}
+}
+
+func (app *application) purgeOldTrash() {
+	ids, err := app.DB.PurgeTrash(time.Now().Add(-app.TrashRetention))
+	if err != nil {
+		slog.Error("failed to purge the trash", "err", err)
+		return
+	}
+
+	for _, id := range ids {
+		app.writeAudit(context.Background(), 0, models.AuditPurge, id, nil, nil)
+	}
+	if len(ids) > 0 {
+		slog.Info("purged movies from the trash", "count", len(ids))
+	}
+}
@@ -0,0 +1,85 @@
+package graph
+
+import (
+	"backend/internals/models"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// what actually goes inside a cursor. clients should treat cursors as
+// opaque strings, so we base64 them to discourage anyone from building
+// their own
+type cursorPayload struct {
+	Field     models.MovieSortField `json:"f"`
+	Direction string                `json:"d"`
+	Value     interface{}           `json:"v"`
+	ID        int                   `json:"id"`
+}
+
+// direction is how a cursor writes down the sort direction
+func direction(descending bool) string {
+	if descending {
+		return "desc"
+	}
+	return "asc"
+}
+
+func encodeCursor(c models.MovieCursor) string {
+	out, err := json.Marshal(cursorPayload{Field: c.Field, Direction: direction(c.Descending), Value: c.Value, ID: c.ID})
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(out)
+}
+
+// decodeCursor turns the string we handed out back into a cursor. a cursor
+// only makes sense for the ordering it was created with, so we refuse one
+// that was made while sorting by a different field or the other way round:
+// the page would silently skip or repeat movies
+func decodeCursor(s string, field models.MovieSortField, descending bool) (*models.MovieCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	var p cursorPayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, errInvalidCursor
+	}
+	if p.Field != field || p.Direction != direction(descending) {
+		return nil, errors.New("cursor does not match the requested sort order")
+	}
+
+	// JSON forgets the types, so put them back based on the column
+	c := models.MovieCursor{Field: p.Field, Descending: descending, ID: p.ID}
+	switch field {
+	case models.SortByRuntime:
+		n, ok := p.Value.(float64)
+		if !ok {
+			return nil, errInvalidCursor
+		}
+		c.Value = int(n)
+	case models.SortByReleaseDate, models.SortByCreatedAt:
+		str, ok := p.Value.(string)
+		if !ok {
+			return nil, errInvalidCursor
+		}
+		t, err := time.Parse(time.RFC3339Nano, str)
+		if err != nil {
+			return nil, errInvalidCursor
+		}
+		c.Value = t
+	default:
+		str, ok := p.Value.(string)
+		if !ok {
+			return nil, errInvalidCursor
+		}
+		c.Value = str
+	}
+
+	return &c, nil
+}
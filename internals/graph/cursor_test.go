@@ -0,0 +1,41 @@
+package graph
+
+import (
+	"backend/internals/models"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	movie := &models.Movie{ID: 7, Title: "Alien", RunTime: 117, ReleaseDate: time.Date(1979, 5, 25, 0, 0, 0, 0, time.UTC)}
+
+	for _, field := range []models.MovieSortField{models.SortByTitle, models.SortByRuntime, models.SortByReleaseDate} {
+		for _, descending := range []bool{false, true} {
+			want := movie.CursorFor(field, descending)
+			got, err := decodeCursor(encodeCursor(want), field, descending)
+			if err != nil {
+				t.Fatalf("%s descending=%v: %v", field, descending, err)
+			}
+			if got.Field != want.Field || got.Descending != want.Descending || got.ID != want.ID {
+				t.Errorf("%s descending=%v: got %+v, want %+v", field, descending, got, want)
+			}
+		}
+	}
+}
+
+// a cursor from a page sorted one way would skip or repeat movies on a
+// query sorted the other way
+func TestCursorRejectsOtherOrder(t *testing.T) {
+	movie := &models.Movie{ID: 7, Title: "Alien"}
+	desc := encodeCursor(movie.CursorFor(models.SortByTitle, true))
+
+	if _, err := decodeCursor(desc, models.SortByTitle, false); err == nil {
+		t.Error("a descending cursor was accepted on an ascending query")
+	}
+	if _, err := decodeCursor(desc, models.SortByRuntime, true); err == nil {
+		t.Error("a title cursor was accepted on a runtime query")
+	}
+	if _, err := decodeCursor("not a cursor", models.SortByTitle, false); err == nil {
+		t.Error("garbage was accepted as a cursor")
+	}
+}
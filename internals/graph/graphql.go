@@ -2,21 +2,41 @@ package graph
 
 import (
 	"backend/internals/models"
+	"backend/internals/repository"
+	"context"
+	"database/sql"
 	"errors"
-	"strings"
+	"fmt"
 
 	"github.com/graphql-go/graphql"
 )
 
+const (
+	// how many movies we hand out when the client doesn't say
+	defaultPageSize = 20
+	// and the most we'll ever hand out in one go
+	maxPageSize = 100
+)
+
 type Graph struct {
-	// we have to populate this with our entire list of movies
-	Movies []*models.Movie
+	// where our movies come from. the resolvers ask the database for
+	// just the page they need instead of us loading every movie up front
+	DB repository.DatabaseRepo
 
 	// this will be the string we receice in order to process whatever
 	// it is we want to do in the backend. i.e like to get an individual movies,
 	// or to get a full list of movies, whatever it may be
 	QueryString string
 
+	// optional values for $variables in the query, and which operation to
+	// run when the query text contains more than one
+	Variables     map[string]interface{}
+	OperationName string
+
+	// the context of the request, the resolvers query the database with
+	// it and the spans of the query hang off it
+	Context context.Context
+
 	Config graphql.SchemaConfig
 	fields graphql.Fields
 
@@ -26,7 +46,7 @@ type Graph struct {
 // It's a factory method used to create a new instance of the graph type
 // this is what we're going to use to populate our graph variable when
 // we create one
-func New(movies []*models.Movie) *Graph {
+func New(db repository.DatabaseRepo) *Graph {
 	// now this will be a relatively long function because we have to
 	// define the object for our movie
 	//and when I'm defining the movie object, I'm going to be describing
@@ -71,6 +91,133 @@ func New(movies []*models.Movie) *Graph {
 	// the movieType acually has the information for a given movie or
 	// for all the movies, depending on what you're doing with it.
 
+	// list and search don't hand back a plain array any more, they return a
+	// Relay style connection: a list of edges (a movie plus its cursor) and
+	// some page info, so the client can ask for the next or previous page
+	var movieEdgeType = graphql.NewObject(
+		graphql.ObjectConfig{
+			Name: "MovieEdge",
+			Fields: graphql.Fields{
+				"cursor": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.String),
+				},
+				"node": &graphql.Field{
+					Type: movieType,
+				},
+			},
+		},
+	)
+
+	var pageInfoType = graphql.NewObject(
+		graphql.ObjectConfig{
+			Name: "PageInfo",
+			Fields: graphql.Fields{
+				"hasNextPage": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.Boolean),
+				},
+				"hasPreviousPage": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.Boolean),
+				},
+				"startCursor": &graphql.Field{
+					Type: graphql.String,
+				},
+				"endCursor": &graphql.Field{
+					Type: graphql.String,
+				},
+			},
+		},
+	)
+
+	var movieConnectionType = graphql.NewObject(
+		graphql.ObjectConfig{
+			Name: "MovieConnection",
+			Fields: graphql.Fields{
+				"edges": &graphql.Field{
+					Type: graphql.NewList(movieEdgeType),
+				},
+				"pageInfo": &graphql.Field{
+					Type: graphql.NewNonNull(pageInfoType),
+				},
+			},
+		},
+	)
+
+	// the things we can sort by, the values are what the repository expects
+	var movieSortFieldType = graphql.NewEnum(
+		graphql.EnumConfig{
+			Name: "MovieSortField",
+			Values: graphql.EnumValueConfigMap{
+				"TITLE":        &graphql.EnumValueConfig{Value: string(models.SortByTitle)},
+				"RELEASE_DATE": &graphql.EnumValueConfig{Value: string(models.SortByReleaseDate)},
+				"RUNTIME":      &graphql.EnumValueConfig{Value: string(models.SortByRuntime)},
+				"CREATED_AT":   &graphql.EnumValueConfig{Value: string(models.SortByCreatedAt)},
+			},
+		},
+	)
+
+	var sortDirectionType = graphql.NewEnum(
+		graphql.EnumConfig{
+			Name: "SortDirection",
+			Values: graphql.EnumValueConfigMap{
+				"ASC":  &graphql.EnumValueConfig{Value: "asc"},
+				"DESC": &graphql.EnumValueConfig{Value: "desc"},
+			},
+		},
+	)
+
+	var movieSortType = graphql.NewInputObject(
+		graphql.InputObjectConfig{
+			Name: "MovieSort",
+			Fields: graphql.InputObjectConfigFieldMap{
+				"field": &graphql.InputObjectFieldConfig{
+					Type:         movieSortFieldType,
+					DefaultValue: string(models.SortByTitle),
+				},
+				"direction": &graphql.InputObjectFieldConfig{
+					Type:         sortDirectionType,
+					DefaultValue: "asc",
+				},
+			},
+		},
+	)
+
+	var movieFilterType = graphql.NewInputObject(
+		graphql.InputObjectConfig{
+			Name: "MovieFilter",
+			Fields: graphql.InputObjectConfigFieldMap{
+				"genreId": &graphql.InputObjectFieldConfig{
+					Type: graphql.Int,
+				},
+				"mpaaRatings": &graphql.InputObjectFieldConfig{
+					Type: graphql.NewList(graphql.NewNonNull(graphql.String)),
+				},
+				"yearFrom": &graphql.InputObjectFieldConfig{
+					Type: graphql.Int,
+				},
+				"yearTo": &graphql.InputObjectFieldConfig{
+					Type: graphql.Int,
+				},
+			},
+		},
+	)
+
+	// every paginated field takes the same arguments
+	connectionArgs := func() graphql.FieldConfigArgument {
+		return graphql.FieldConfigArgument{
+			"first":  &graphql.ArgumentConfig{Type: graphql.Int},
+			"after":  &graphql.ArgumentConfig{Type: graphql.String},
+			"last":   &graphql.ArgumentConfig{Type: graphql.Int},
+			"before": &graphql.ArgumentConfig{Type: graphql.String},
+			"sort":   &graphql.ArgumentConfig{Type: movieSortType},
+			"filter": &graphql.ArgumentConfig{Type: movieFilterType},
+		}
+	}
+
+	searchArgs := connectionArgs()
+	searchArgs["titleContains"] = &graphql.ArgumentConfig{
+		Type: graphql.String,
+	}
+
 	// fields defines the available actions on the data
 	// like: list, search , get
 	// so to define this variable fields, we need to populate it with the
@@ -79,54 +226,37 @@ func New(movies []*models.Movie) *Graph {
 		// action {list}
 		//** List Directive **
 		"list": &graphql.Field{
-			Type:        graphql.NewList(movieType), // that what're dealing with, that our data
-			Description: "Get all movies",
+			Type:        movieConnectionType, // that what're dealing with, that our data
+			Description: "Get all movies, one page at a time",
+			Args:        connectionArgs(),
 
 			// what happens when we execute this action(list)
 			Resolve: func(params graphql.ResolveParams) (interface{}, error) {
-				return movies, nil
+				return resolveConnection(db.WithContext(params.Context), params.Args, models.MovieFilter{})
 			},
 		},
 
 		//** Search Directive ***
 		// we want to search for particular movies
 		"search": &graphql.Field{
-			Type:        graphql.NewList(movieType),
+			Type:        movieConnectionType,
 			Description: "Search movies by title",
 			// this one is going to take arguments
 			// obviously, if you're searching for something,
 			// you need to specify the argument that you're
 			// searching for.
-			Args: graphql.FieldConfigArgument{
-				"titleContains": &graphql.ArgumentConfig{
-					Type: graphql.String,
-				},
-			},
+			Args: searchArgs,
 
 			// then we have resolve
-			// how do you do this?
+			// the database does the searching for us now, we just
+			// pass the title along with the rest of the filter
 			Resolve: func(params graphql.ResolveParams) (interface{}, error) {
-				// here we're going to returning a subset of the list of movies
-				// so we're not returning the entire list
-				// we 're just returning anything that matches our search parameter
-
-				// what we're going to return
-				var theList []*models.Movie
 				search, ok := params.Args["titleContains"].(string)
-				// then we range through all of our movies
-				if ok {
-					// we're just going through the entire list
-					for _, currentMovie := range movies {
-						// check to see if the title we're looking at contains
-						// the characters we're searching for.
-						// we also have to make sure that it's case insensitive
-						if strings.Contains(strings.ToLower(currentMovie.Title), strings.ToLower(search)) {
-							// if we found a match
-							theList = append(theList, currentMovie)
-						}
-					}
+				if !ok || search == "" {
+					// nothing to search for, nothing found
+					return connection(&models.MoviePage{}, models.SortByTitle, false), nil
 				}
-				return theList, nil
+				return resolveConnection(db.WithContext(params.Context), params.Args, models.MovieFilter{TitleContains: search})
 			},
 		},
 
@@ -142,38 +272,168 @@ func New(movies []*models.Movie) *Graph {
 			},
 			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
 				id, ok := p.Args["id"].(int)
-				if ok {
-					for _, movie := range movies {
-						if movie.ID == id {
-							// we found the movie
-							return movie, nil
-						}
+				if !ok {
+					return nil, nil
+				}
+				movie, err := db.WithContext(p.Context).OneMovie(id)
+				if err != nil {
+					if errors.Is(err, sql.ErrNoRows) {
+						// we didn't find it
+						return nil, nil
 					}
+					return nil, err
 				}
-				// we didn't find it
-				return nil, nil
+				return movie, nil
 			},
 		},
 	}
 
 	return &Graph{
-		Movies:    movies,
+		DB:        db,
 		fields:    fields,
 		movieType: movieType,
 	}
 
 }
 
+// resolveConnection reads the pagination, sort and filter arguments,
+// asks the database for that page and turns it into a connection
+func resolveConnection(db repository.DatabaseRepo, args map[string]interface{}, filter models.MovieFilter) (interface{}, error) {
+	page, err := pageRequest(args, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := db.MoviesPage(page)
+	if err != nil {
+		return nil, err
+	}
+
+	return connection(result, page.SortField, page.Descending), nil
+}
+
+// pageRequest turns the GraphQL arguments into something the repository
+// understands
+func pageRequest(args map[string]interface{}, filter models.MovieFilter) (models.MoviePageRequest, error) {
+	page := models.MoviePageRequest{SortField: models.SortByTitle}
+
+	if sort, ok := args["sort"].(map[string]interface{}); ok {
+		if field, ok := sort["field"].(string); ok {
+			page.SortField = models.MovieSortField(field)
+		}
+		if direction, ok := sort["direction"].(string); ok {
+			page.Descending = direction == "desc"
+		}
+	}
+
+	if f, ok := args["filter"].(map[string]interface{}); ok {
+		if genreID, ok := f["genreId"].(int); ok {
+			filter.GenreID = genreID
+		}
+		if ratings, ok := f["mpaaRatings"].([]interface{}); ok {
+			for _, r := range ratings {
+				if rating, ok := r.(string); ok {
+					filter.MPAARatings = append(filter.MPAARatings, rating)
+				}
+			}
+		}
+		if yearFrom, ok := f["yearFrom"].(int); ok {
+			filter.YearFrom = yearFrom
+		}
+		if yearTo, ok := f["yearTo"].(int); ok {
+			filter.YearTo = yearTo
+		}
+	}
+	page.Filter = filter
+
+	first, hasFirst := args["first"].(int)
+	last, hasLast := args["last"].(int)
+	if hasFirst && hasLast {
+		return page, errors.New("use either first or last, not both")
+	}
+	// an empty page can't say whether there's more after it, a client
+	// paging on hasNextPage would ask for it forever
+	if (hasFirst && first < 1) || (hasLast && last < 1) {
+		return page, errors.New("first and last must be at least 1")
+	}
+	if (hasFirst && first > maxPageSize) || (hasLast && last > maxPageSize) {
+		return page, fmt.Errorf("a page can have at most %d movies", maxPageSize)
+	}
+	if !hasFirst && !hasLast {
+		first = defaultPageSize
+	}
+	page.First = first
+	page.Last = last
+
+	if after, ok := args["after"].(string); ok {
+		c, err := decodeCursor(after, page.SortField, page.Descending)
+		if err != nil {
+			return page, err
+		}
+		page.After = c
+	}
+	if before, ok := args["before"].(string); ok {
+		c, err := decodeCursor(before, page.SortField, page.Descending)
+		if err != nil {
+			return page, err
+		}
+		page.Before = c
+	}
+
+	return page, nil
+}
+
+// connection builds the MovieConnection the client gets back
+func connection(page *models.MoviePage, field models.MovieSortField, descending bool) map[string]interface{} {
+	edges := make([]map[string]interface{}, 0, len(page.Movies))
+	for _, movie := range page.Movies {
+		edges = append(edges, map[string]interface{}{
+			"cursor": encodeCursor(movie.CursorFor(field, descending)),
+			"node":   movie,
+		})
+	}
+
+	pageInfo := map[string]interface{}{
+		"hasNextPage":     page.HasNextPage,
+		"hasPreviousPage": page.HasPreviousPage,
+		"startCursor":     nil,
+		"endCursor":       nil,
+	}
+	if len(edges) > 0 {
+		pageInfo["startCursor"] = edges[0]["cursor"]
+		pageInfo["endCursor"] = edges[len(edges)-1]["cursor"]
+	}
+
+	return map[string]interface{}{
+		"edges":    edges,
+		"pageInfo": pageInfo,
+	}
+}
+
 // this method allow us to perform queries
 func (g *Graph) Query() (*graphql.Result, error) {
 	rootQuery := graphql.ObjectConfig{Name: "RootQuery", Fields: g.fields}
-	schemaConfig := graphql.SchemaConfig{Query: graphql.NewObject(rootQuery)}
+	schemaConfig := graphql.SchemaConfig{
+		Query:      graphql.NewObject(rootQuery),
+		Extensions: []graphql.Extension{&tracingExtension{}},
+	}
 	schema, err := graphql.NewSchema(schemaConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	params := graphql.Params{Schema: schema, RequestString: g.QueryString}
+	ctx := g.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	params := graphql.Params{
+		Context:        ctx,
+		Schema:         schema,
+		RequestString:  g.QueryString,
+		VariableValues: g.Variables,
+		OperationName:  g.OperationName,
+	}
 	resp := graphql.Do(params)
 
 	// check for error(it's a different the way to check for errors)
@@ -0,0 +1,29 @@
+package graph
+
+import (
+	"backend/internals/models"
+	"testing"
+)
+
+func TestPageRequestSize(t *testing.T) {
+	tests := []struct {
+		args map[string]interface{}
+		ok   bool
+	}{
+		{map[string]interface{}{}, true},
+		{map[string]interface{}{"first": 1}, true},
+		{map[string]interface{}{"last": maxPageSize}, true},
+		// an empty page would always have a next one
+		{map[string]interface{}{"first": 0}, false},
+		{map[string]interface{}{"last": 0}, false},
+		{map[string]interface{}{"first": -1}, false},
+		{map[string]interface{}{"first": maxPageSize + 1}, false},
+		{map[string]interface{}{"first": 1, "last": 1}, false},
+	}
+	for _, tt := range tests {
+		_, err := pageRequest(tt.args, models.MovieFilter{})
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: got %v", tt.args, err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package graph
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// the most queries we'll remember when clients register them on the fly,
+// so nobody can fill up our memory by sending us random queries
+const maxPersistedQueries = 1000
+
+// PersistedQueries remembers queries by the SHA-256 hash of their text.
+// this is what the Automatic Persisted Queries (APQ) protocol is built on:
+// a client sends just the hash, and only sends the full query the first
+// time, when we tell them we don't know it yet
+type PersistedQueries struct {
+	mu      sync.RWMutex
+	queries map[string]string
+	// queries that came from the manifest, registered ones don't count
+	// towards the allow-list
+	allowed map[string]bool
+}
+
+func NewPersistedQueries() *PersistedQueries {
+	return &PersistedQueries{
+		queries: make(map[string]string),
+		allowed: make(map[string]bool),
+	}
+}
+
+// HashQuery returns the hex encoded SHA-256 of a query, the same way
+// APQ clients compute it
+func HashQuery(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:])
+}
+
+// Lookup finds the query text for a hash
+func (p *PersistedQueries) Lookup(hash string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	query, ok := p.queries[strings.ToLower(hash)]
+	return query, ok
+}
+
+// Allowed tells us whether a hash is on the allow-list we loaded at startup
+func (p *PersistedQueries) Allowed(hash string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.allowed[strings.ToLower(hash)]
+}
+
+// Register stores a query sent by a client. the client tells us the hash,
+// and we make sure it really is the hash of the query before we keep it
+func (p *PersistedQueries) Register(hash, query string) error {
+	hash = strings.ToLower(hash)
+	if HashQuery(query) != hash {
+		return errors.New("provided sha does not match query")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.queries[hash]; ok {
+		return nil
+	}
+	if len(p.queries) >= maxPersistedQueries {
+		// we're full, the query still runs, we just won't remember it
+		return nil
+	}
+	p.queries[hash] = query
+	return nil
+}
+
+// LoadManifest reads the allow-list our front end build produces. it's a
+// JSON object of hash => query text, for example
+//
+//	{ "ecf4edb4...": "{ list { edges { node { id title } } } }" }
+//
+// every hash is checked against its query so a typo can't let in
+// something we didn't mean to allow
+func (p *PersistedQueries) LoadManifest(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var manifest map[string]string
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return fmt.Errorf("reading persisted query manifest: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for hash, query := range manifest {
+		hash = strings.ToLower(hash)
+		if HashQuery(query) != hash {
+			return fmt.Errorf("persisted query manifest: hash %s does not match its query", hash)
+		}
+		p.queries[hash] = query
+		p.allowed[hash] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package graph
+
+import (
+	"context"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("backend/internals/graph")
+
+// tracingExtension gives every phase of a query a span of its own: parsing,
+// validating, executing, and resolving each of the fields at the top of
+// the query (list, search, get), so the database calls a resolver makes
+// show up under it. a new one is made for every query
+type tracingExtension struct {
+	// the context of the execute span, the parent of the field spans
+	execCtx context.Context
+}
+
+var _ graphql.Extension = (*tracingExtension)(nil)
+
+func (t *tracingExtension) Init(ctx context.Context, p *graphql.Params) context.Context {
+	return ctx
+}
+
+func (t *tracingExtension) Name() string {
+	return "tracing"
+}
+
+// graphql-go carries on with the context we return here, so parsing and
+// validating hand back the one they got. otherwise everything after them
+// would end up inside their spans
+func (t *tracingExtension) ParseDidStart(ctx context.Context) (context.Context, graphql.ParseFinishFunc) {
+	_, span := tracer.Start(ctx, "graphql.parse")
+	return ctx, func(err error) {
+		endSpan(span, err)
+	}
+}
+
+func (t *tracingExtension) ValidationDidStart(ctx context.Context) (context.Context, graphql.ValidationFinishFunc) {
+	_, span := tracer.Start(ctx, "graphql.validate")
+	return ctx, func(errs []gqlerrors.FormattedError) {
+		if len(errs) > 0 {
+			span.SetStatus(codes.Error, errs[0].Message)
+		}
+		span.End()
+	}
+}
+
+func (t *tracingExtension) ExecutionDidStart(ctx context.Context) (context.Context, graphql.ExecutionFinishFunc) {
+	ctx, span := tracer.Start(ctx, "graphql.execute")
+	t.execCtx = ctx
+	return ctx, func(result *graphql.Result) {
+		if result != nil && len(result.Errors) > 0 {
+			span.SetStatus(codes.Error, result.Errors[0].Message)
+		}
+		span.End()
+	}
+}
+
+func (t *tracingExtension) ResolveFieldDidStart(ctx context.Context, info *graphql.ResolveInfo) (context.Context, graphql.ResolveFieldFinishFunc) {
+	// the fields of a movie are read straight off the struct, a span for
+	// each of them would only be noise
+	if info.Path == nil || info.Path.Prev != nil || t.execCtx == nil {
+		return ctx, func(interface{}, error) {}
+	}
+
+	// the context we return is kept for every field after this one too,
+	// so we start from the execute span and not from whatever ctx is
+	ctx, span := tracer.Start(t.execCtx, "graphql.resolve "+info.FieldName,
+		trace.WithAttributes(
+			attribute.String("graphql.field.name", info.FieldName),
+			attribute.String("graphql.field.type", info.ReturnType.String()),
+		),
+	)
+	return ctx, func(_ interface{}, err error) {
+		endSpan(span, err)
+	}
+}
+
+func (t *tracingExtension) HasResult() bool {
+	return false
+}
+
+func (t *tracingExtension) GetResult(ctx context.Context) interface{} {
+	return nil
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
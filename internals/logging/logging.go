@@ -0,0 +1,121 @@
+// Package logging sets up the structured logger the API uses: JSON or
+// text, with the request id (and trace id) of the request being served on
+// every line, and secrets replaced before anything is written
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// what a redacted value is replaced with
+const Redacted = "[REDACTED]"
+
+// the keys whose values we never write out, whatever they hold
+var sensitiveKeys = map[string]bool{
+	"password":      true,
+	"new_password":  true,
+	"secret":        true,
+	"jwt_secret":    true,
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"api_key":       true,
+	"apikey":        true,
+	"authorization": true,
+	"cookie":        true,
+	"set-cookie":    true,
+	"dsn":           true,
+}
+
+// secrets hiding inside a longer value, like the api key in a URL or the
+// password in a connection string
+var sensitivePairs = regexp.MustCompile(`(?i)\b(api_key|apikey|access_token|refresh_token|token|password|secret)=([^&\s]+)`)
+
+type requestIDKey struct{}
+
+// WithRequestID stores the id of the request being served in ctx, every
+// line logged with ctx carries it
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID is the id stored by WithRequestID, or "" when there isn't one
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// New returns a logger that writes to w, as JSON when format is "json"
+// and as key=value text otherwise
+func New(w io.Writer, format string, level slog.Level) *slog.Logger {
+	opts := &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redact,
+	}
+
+	var h slog.Handler
+	if format == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(contextHandler{h})
+}
+
+// ParseLevel turns debug, info, warn or error into a level
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// Redact hides the secrets in s, "?api_key=abc" becomes "?api_key=[REDACTED]"
+func Redact(s string) string {
+	return sensitivePairs.ReplaceAllString(s, "$1="+Redacted)
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, Redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(Redact(a.Value.String()))
+	case slog.KindAny:
+		// errors often quote the URL or query that failed
+		if err, ok := a.Value.Any().(error); ok {
+			a.Value = slog.StringValue(Redact(err.Error()))
+		}
+	}
+	return a
+}
+
+// contextHandler adds the request id from the context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	// so a log line can be found from its trace and the other way round
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,50 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"https://api.example.com/search?api_key=abc123&query=alien",
+			"https://api.example.com/search?api_key=[REDACTED]&query=alien"},
+		{"host=db user=movies password=hunter2 dbname=movies",
+			"host=db user=movies password=[REDACTED] dbname=movies"},
+		{"/reset?TOKEN=xyz", "/reset?TOKEN=[REDACTED]"},
+		{"access_token=a&refresh_token=b", "access_token=[REDACTED]&refresh_token=[REDACTED]"},
+		{"nothing to hide here", "nothing to hide here"},
+		{"password= ", "password= "},
+	}
+	for _, tt := range tests {
+		if got := Redact(tt.in); got != tt.want {
+			t.Errorf("Redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLoggerRedacts(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, "json", slog.LevelInfo)
+
+	logger.Info("login",
+		"password", "hunter2",
+		"Authorization", "Bearer abc",
+		"url", "/search?apikey=k1",
+		"err", errors.New("GET /movies?api_key=k2 failed"),
+		"email", "someone@example.com",
+	)
+
+	out := buf.String()
+	for _, secret := range []string{"hunter2", "Bearer abc", "k1", "k2"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("%q made it into the log: %s", secret, out)
+		}
+	}
+	if !strings.Contains(out, "someone@example.com") {
+		t.Errorf("a value that isn't a secret was redacted: %s", out)
+	}
+}
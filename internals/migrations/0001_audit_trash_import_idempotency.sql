@@ -0,0 +1,36 @@
+-- the audit trail of movie changes, the trash, external ids for imports
+-- and idempotency keys, on top of the tables we started with
+
+CREATE TABLE IF NOT EXISTS public.movie_audit (
+    id integer GENERATED ALWAYS AS IDENTITY,
+    movie_id integer NOT NULL,
+    user_id integer,
+    action character varying(32) NOT NULL,
+    before jsonb,
+    after jsonb,
+    changes jsonb,
+    created_at timestamp without time zone NOT NULL,
+    CONSTRAINT movie_audit_pkey PRIMARY KEY (id),
+    CONSTRAINT movie_audit_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS movie_audit_movie_id_idx ON public.movie_audit USING btree (movie_id, created_at);
+
+ALTER TABLE public.movies ADD COLUMN IF NOT EXISTS deleted_at timestamp without time zone;
+
+CREATE INDEX IF NOT EXISTS movies_deleted_at_idx ON public.movies USING btree (deleted_at) WHERE (deleted_at IS NOT NULL);
+
+ALTER TABLE public.movies ADD COLUMN IF NOT EXISTS external_id character varying(255);
+
+CREATE UNIQUE INDEX IF NOT EXISTS movies_external_id_idx ON public.movies USING btree (external_id) WHERE (external_id IS NOT NULL);
+
+CREATE TABLE IF NOT EXISTS public.idempotency_keys (
+    key character varying(255) NOT NULL,
+    user_id integer NOT NULL,
+    request_hash character varying(64) NOT NULL,
+    status_code integer,
+    response_headers jsonb,
+    response_body bytea,
+    created_at timestamp without time zone NOT NULL,
+    CONSTRAINT idempotency_keys_pkey PRIMARY KEY (user_id, key)
+);
@@ -0,0 +1,17 @@
+-- the token buckets of the rate limiter and the failed logins of the
+-- lockout, for when they're kept in postgres
+
+CREATE TABLE IF NOT EXISTS public.login_failures (
+    key character varying(255) NOT NULL,
+    failures integer NOT NULL,
+    last_failure_at timestamp with time zone NOT NULL,
+    locked_until timestamp with time zone,
+    CONSTRAINT login_failures_pkey PRIMARY KEY (key)
+);
+
+CREATE TABLE IF NOT EXISTS public.rate_limits (
+    key character varying(512) NOT NULL,
+    tokens double precision NOT NULL,
+    updated_at timestamp with time zone NOT NULL,
+    CONSTRAINT rate_limits_pkey PRIMARY KEY (key)
+);
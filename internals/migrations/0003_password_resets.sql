@@ -0,0 +1,16 @@
+-- password reset tokens, and a token version on users so a reset can end
+-- every session
+
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS token_version integer DEFAULT 0 NOT NULL;
+
+CREATE TABLE IF NOT EXISTS public.password_resets (
+    token_hash character varying(64) NOT NULL,
+    user_id integer NOT NULL,
+    expires_at timestamp with time zone NOT NULL,
+    used_at timestamp with time zone,
+    created_at timestamp with time zone NOT NULL,
+    CONSTRAINT password_resets_pkey PRIMARY KEY (token_hash),
+    CONSTRAINT password_resets_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS password_resets_user_id_idx ON public.password_resets USING btree (user_id);
@@ -0,0 +1,26 @@
+-- verifying email addresses. the users we had before there was any
+-- verification keep working, their addresses count as verified
+
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_schema = 'public' AND table_name = 'users' AND column_name = 'email_verified_at'
+    ) THEN
+        ALTER TABLE public.users ADD COLUMN email_verified_at timestamp with time zone;
+        UPDATE public.users SET email_verified_at = now();
+    END IF;
+END
+$$;
+
+CREATE TABLE IF NOT EXISTS public.email_verifications (
+    token_hash character varying(64) NOT NULL,
+    user_id integer NOT NULL,
+    email character varying(255) NOT NULL,
+    expires_at timestamp with time zone NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    CONSTRAINT email_verifications_pkey PRIMARY KEY (token_hash),
+    CONSTRAINT email_verifications_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS email_verifications_user_id_idx ON public.email_verifications USING btree (user_id);
@@ -0,0 +1,28 @@
+-- roles, and two-factor authentication with an app and recovery codes.
+-- before there were roles everybody who could log in could use /admin,
+-- the users we already have stay admins
+
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_schema = 'public' AND table_name = 'users' AND column_name = 'role'
+    ) THEN
+        ALTER TABLE public.users ADD COLUMN role character varying(32) DEFAULT 'user'::character varying NOT NULL;
+        UPDATE public.users SET role = 'admin';
+    END IF;
+END
+$$;
+
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS totp_secret character varying(64);
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS totp_enabled_at timestamp with time zone;
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS totp_last_step bigint DEFAULT 0 NOT NULL;
+
+CREATE TABLE IF NOT EXISTS public.mfa_recovery_codes (
+    user_id integer NOT NULL,
+    code_hash character varying(64) NOT NULL,
+    used_at timestamp with time zone,
+    created_at timestamp with time zone NOT NULL,
+    CONSTRAINT mfa_recovery_codes_pkey PRIMARY KEY (user_id, code_hash),
+    CONSTRAINT mfa_recovery_codes_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
@@ -0,0 +1,4 @@
+-- an email address belongs to one account, whatever its case. this fails
+-- when two accounts share an address already, sort those out by hand first
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_key ON public.users USING btree (lower((email)::text));
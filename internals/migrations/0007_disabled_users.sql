@@ -0,0 +1,4 @@
+-- admins can disable accounts, and create them with a temporary password
+
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS disabled_at timestamp with time zone;
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS password_change_required boolean DEFAULT false NOT NULL;
@@ -0,0 +1,153 @@
+// Package migrations brings the database schema up to date. every change
+// to the schema is a numbered SQL file in this directory (0007_name.sql),
+// applied in order and written down in schema_migrations, so a database
+// made from any older sql/create_tables.sql can be upgraded where it is.
+// the files only create what isn't there yet, running one twice is fine
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+// only one instance changes the schema at a time, the others wait on this
+// (an arbitrary number, it just has to be the same everywhere)
+const lockID = 72657478
+
+// Migration is one change to the schema
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// All returns every migration, oldest first. the versions have to go
+// 1, 2, 3... without gaps, so nobody can skip one by accident
+func All() ([]Migration, error) {
+	names, err := fs.Glob(files, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	var all []Migration
+	for _, name := range names {
+		number, rest, ok := strings.Cut(name, "_")
+		version, err := strconv.Atoi(number)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("migration %s: the name must be a version, an underscore and a name", name)
+		}
+		body, err := files.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, Migration{
+			Version: version,
+			Name:    strings.TrimSuffix(rest, ".sql"),
+			SQL:     string(body),
+		})
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].Version < all[j].Version })
+	for i, m := range all {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d_%s: expected version %d", m.Version, m.Name, i+1)
+		}
+	}
+	return all, nil
+}
+
+// Latest is the version the schema has once every migration is applied,
+// the one this build works with
+func Latest() int {
+	all, err := All()
+	if err != nil {
+		// the files are built into the binary, TestMigrations catches this
+		panic(err)
+	}
+	return len(all)
+}
+
+// Up applies the migrations the database doesn't have yet, each in a
+// transaction of its own along with the new version. it gives back the
+// versions the schema had before and has now
+func Up(ctx context.Context, db *sql.DB) (from, to int, err error) {
+	all, err := All()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// the lock belongs to a connection, so we stick to one
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `select pg_advisory_lock($1)`, lockID); err != nil {
+		return 0, 0, err
+	}
+	defer conn.ExecContext(context.WithoutCancel(ctx), `select pg_advisory_unlock($1)`, lockID)
+
+	_, err = conn.ExecContext(ctx, `create table if not exists public.schema_migrations (
+		version bigint NOT NULL,
+		dirty boolean NOT NULL,
+		CONSTRAINT schema_migrations_pkey PRIMARY KEY (version)
+	)`)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// a database from before there were migrations has no row yet
+	var dirty bool
+	err = conn.QueryRowContext(ctx, `select version, dirty from schema_migrations
+		order by version desc limit 1`).Scan(&from, &dirty)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, err
+	}
+	if dirty {
+		return from, from, fmt.Errorf("the schema is marked dirty at version %d, fix it by hand first", from)
+	}
+
+	to = from
+	for _, m := range all {
+		if m.Version <= from {
+			continue
+		}
+		if err := apply(ctx, conn, m); err != nil {
+			return from, to, fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+		}
+		to = m.Version
+	}
+	return from, to, nil
+}
+
+func apply(ctx context.Context, conn *sql.Conn, m Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// without arguments the statements go as one simple query, so a file
+	// can have as many as it likes
+	if _, err := tx.ExecContext(ctx, m.SQL); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `delete from schema_migrations`); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `insert into schema_migrations (version, dirty) values ($1, false)`, m.Version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,39 @@
+package migrations
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	all, err := All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) == 0 {
+		t.Fatal("no migrations")
+	}
+	for _, m := range all {
+		if m.Name == "" || m.SQL == "" {
+			t.Errorf("migration %d is empty", m.Version)
+		}
+	}
+}
+
+// a database made from sql/create_tables.sql has to start out at the
+// latest version, or the next start would apply migrations it already has
+func TestDumpIsAtLatestVersion(t *testing.T) {
+	dump, err := os.ReadFile("../../sql/create_tables.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := regexp.MustCompile(`(?m)^COPY public\.schema_migrations \(version, dirty\) FROM stdin;\n(\d+)\t`).FindSubmatch(dump)
+	if match == nil {
+		t.Fatal("sql/create_tables.sql doesn't seed schema_migrations")
+	}
+	if got, want := string(match[1]), fmt.Sprint(Latest()); got != want {
+		t.Errorf("sql/create_tables.sql is at version %s, the migrations at %s", got, want)
+	}
+}
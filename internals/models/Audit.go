@@ -0,0 +1,37 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// the kinds of things an admin can do to a movie
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditPurge   = "purge"
+	AuditImport  = "import"
+)
+
+// AuditEntry records one change an admin made to a movie.
+// Before and After are the movie (with its genre ids) as JSON, so we can
+// put a movie back the way it was, Before is empty for a create and After
+// is empty for a delete
+type AuditEntry struct {
+	ID        int                    `json:"id"`
+	MovieID   int                    `json:"movie_id"`
+	UserID    int                    `json:"user_id"`
+	Action    string                 `json:"action"`
+	Before    json.RawMessage        `json:"before,omitempty"`
+	After     json.RawMessage        `json:"after,omitempty"`
+	Changes   map[string]FieldChange `json:"changes,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// FieldChange is one field that is different between Before and After
+type FieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
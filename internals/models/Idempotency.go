@@ -0,0 +1,21 @@
+package models
+
+import (
+	"net/http"
+	"time"
+)
+
+// IdempotencyRecord remembers a request that was sent with an
+// Idempotency-Key header and the response we gave, so when a client sends
+// the same request again (because it never saw our answer) we give the
+// same answer instead of doing the work twice.
+// StatusCode is 0 while the first request is still being handled
+type IdempotencyRecord struct {
+	Key         string
+	UserID      int
+	RequestHash string
+	StatusCode  int
+	Header      http.Header
+	Body        []byte
+	CreatedAt   time.Time
+}
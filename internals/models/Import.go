@@ -0,0 +1,47 @@
+package models
+
+import "time"
+
+// what happened to one row of a bulk import
+const (
+	ImportCreated = "created"
+	ImportUpdated = "updated"
+	ImportFailed  = "failed"
+)
+
+// MovieImportRow is one movie from an uploaded CSV or NDJSON file, after
+// it's been checked. Line is where it was in the file, so we can point the
+// editor at the right row when something is wrong
+type MovieImportRow struct {
+	Line        int
+	ExternalID  string
+	Title       string
+	ReleaseDate time.Time
+	RunTime     int
+	MPAARating  string
+	Description string
+	GenreIDs    []int
+}
+
+// ImportResult is the outcome for one row of the file
+type ImportResult struct {
+	Line    int      `json:"line"`
+	Status  string   `json:"status"`
+	MovieID int      `json:"movie_id,omitempty"`
+	Title   string   `json:"title,omitempty"`
+	Errors  []string `json:"errors,omitempty"`
+	// how an updated movie looked before the import, for the audit trail
+	Before *Movie `json:"-"`
+}
+
+// ImportReport is what we send back after an import. when Committed is
+// false nothing was saved, and the statuses say what would have happened
+type ImportReport struct {
+	DryRun    bool           `json:"dry_run"`
+	Atomic    bool           `json:"atomic"`
+	Committed bool           `json:"committed"`
+	Created   int            `json:"created"`
+	Updated   int            `json:"updated"`
+	Failed    int            `json:"failed"`
+	Rows      []ImportResult `json:"rows"`
+}
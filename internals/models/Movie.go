@@ -4,17 +4,19 @@ import "time"
 
 // anytime we want to deal with a movie we can use this Movie type
 type Movie struct {
-	ID          int       `json:"id"`
-	Title       string    `json:"title"`
-	ReleaseDate time.Time `json:"release_date"`
-	RunTime     int       `json:"runtime"`
-	MPAARating  string    `json:"mpaa_rating"`
-	Description string    `json:"description"`
-	Image       string    `json:"image"`
-	CreatedAt   time.Time `json:"-"` // "-" means don't include it in JSON
-	UpdateAt    time.Time `json:"-"` // ingore this field in JSON
-	Genres      []*Genre  `json:"genres,omitempty"`
-	GenresArray []int     `json:"genres_array,omitempty"`
+	ID          int        `json:"id"`
+	Title       string     `json:"title"`
+	ReleaseDate time.Time  `json:"release_date"`
+	RunTime     int        `json:"runtime"`
+	MPAARating  string     `json:"mpaa_rating"`
+	Description string     `json:"description"`
+	Image       string     `json:"image"`
+	ExternalID  string     `json:"external_id,omitempty"` // id in the catalog spreadsheets, used by import/export
+	CreatedAt   time.Time  `json:"-"`                     // "-" means don't include it in JSON
+	UpdateAt    time.Time  `json:"-"`                     // ingore this field in JSON
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`  // set when the movie is in the trash
+	Genres      []*Genre   `json:"genres,omitempty"`
+	GenresArray []int      `json:"genres_array,omitempty"`
 }
 
 type Genre struct {
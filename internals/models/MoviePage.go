@@ -0,0 +1,74 @@
+package models
+
+import "time"
+
+// the columns a page of movies can be ordered by. the value is the name
+// of the database column, so it can go straight into an order by clause
+type MovieSortField string
+
+const (
+	SortByTitle       MovieSortField = "title"
+	SortByReleaseDate MovieSortField = "release_date"
+	SortByRuntime     MovieSortField = "runtime"
+	SortByCreatedAt   MovieSortField = "created_at"
+)
+
+// MovieFilter narrows down which movies are returned.
+// zero values mean "don't filter on this"
+type MovieFilter struct {
+	TitleContains string
+	GenreID       int
+	MPAARatings   []string
+	YearFrom      int
+	YearTo        int
+	UpdatedSince  time.Time
+}
+
+// MovieCursor points at one movie in an ordered list. we don't use offsets,
+// we remember the value of the sort column and the id of the last movie we
+// handed out, and the next page starts right after it (keyset pagination)
+type MovieCursor struct {
+	Field      MovieSortField
+	Descending bool
+	Value      interface{} // string, int or time.Time depending on Field
+	ID         int
+}
+
+// MoviePageRequest describes one page of movies.
+// use First/After to go forward and Last/Before to go backward
+type MoviePageRequest struct {
+	Filter     MovieFilter
+	SortField  MovieSortField
+	Descending bool
+	First      int
+	After      *MovieCursor
+	Last       int
+	Before     *MovieCursor
+}
+
+// MoviePage is what the repository gives back for a MoviePageRequest
+type MoviePage struct {
+	Movies          []*Movie
+	HasNextPage     bool
+	HasPreviousPage bool
+}
+
+// SortValue returns the value of the column we're sorting by for this movie,
+// this is what goes into the cursor
+func (m *Movie) SortValue(field MovieSortField) interface{} {
+	switch field {
+	case SortByReleaseDate:
+		return m.ReleaseDate
+	case SortByRuntime:
+		return m.RunTime
+	case SortByCreatedAt:
+		return m.CreatedAt
+	default:
+		return m.Title
+	}
+}
+
+// CursorFor builds the cursor that points at this movie
+func (m *Movie) CursorFor(field MovieSortField, descending bool) MovieCursor {
+	return MovieCursor{Field: field, Descending: descending, Value: m.SortValue(field), ID: m.ID}
+}
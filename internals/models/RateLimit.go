@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// RateLimitBucket is the token bucket of one client (an IP on a route).
+// every request takes a token, tokens come back at a steady rate up to a
+// maximum. a zero UpdatedAt is a bucket we've never seen, which is full
+type RateLimitBucket struct {
+	Key       string
+	Tokens    float64
+	UpdatedAt time.Time
+}
+
+// LoginFailures counts the failed logins for an email address, and until
+// when logging in as it is locked. we keep these for addresses that
+// don't belong to anybody too, so a locked account doesn't give away
+// that it exists
+type LoginFailures struct {
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   time.Time
+}
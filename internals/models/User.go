@@ -8,13 +8,73 @@ import (
 )
 
 type User struct {
-	ID        int       `json:"id"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	Password  string    `json:"password"`
-	CreatedAt time.Time `json:"-"`
+	ID        int    `json:"id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+	// the bcrypt hash of the password, which never leaves the server
+	Password  string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"-"`
+	// goes up every time the sessions of the user are revoked (when the
+	// password is reset, say). refresh tokens carry the version they were
+	// issued with, the ones with an older version don't work any more
+	TokenVersion int `json:"-"`
+	// when the user proved the email address is theirs, nil until they do
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	// what the user is allowed to do, "user" or "admin"
+	Role string `json:"role"`
+	// the secret of the authenticator app of the user. it's set as soon
+	// as they start enrolling, but only asked for once TOTPEnabledAt is
+	// set, when they confirmed the app works
+	TOTPSecret    string     `json:"-"`
+	TOTPEnabledAt *time.Time `json:"-"`
+	// the time step of the last code the user logged in with, a code
+	// is only good once
+	TOTPLastStep int64 `json:"-"`
+	// when an admin disabled the account, a disabled user can't log in
+	DisabledAt *time.Time `json:"disabled_at"`
+	// the password is a temporary one an admin made up, the user should
+	// choose their own
+	PasswordChangeRequired bool `json:"password_change_required"`
+}
+
+// EmailVerified tells whether the user proved their email address is theirs
+func (u *User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// PasswordReset is a token we mailed to a user so they can set a new
+// password. we only keep the SHA-256 of the token, somebody reading the
+// table can't use it. a token works once and not after ExpiresAt
+type PasswordReset struct {
+	TokenHash string
+	UserID    int
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// MFAEnabled tells whether logging in as the user takes a code from their
+// authenticator app (or a recovery code) after the password
+func (u *User) MFAEnabled() bool {
+	return u.TOTPEnabledAt != nil
+}
+
+// Disabled tells whether an admin disabled the account
+func (u *User) Disabled() bool {
+	return u.DisabledAt != nil
+}
+
+// EmailVerification is a token we mailed to a user to prove Email is
+// their address. like a PasswordReset we only keep its SHA-256. when the
+// user's address changed since, the token doesn't verify the new one
+type EmailVerification struct {
+	TokenHash string
+	UserID    int
+	Email     string
+	ExpiresAt time.Time
+	CreatedAt time.Time
 }
 
 func (u *User) PasswordMatches(plainText string) (bool, error) {
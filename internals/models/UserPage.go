@@ -0,0 +1,26 @@
+package models
+
+// UserFilter narrows down which users are listed.
+// zero values mean "don't filter on this"
+type UserFilter struct {
+	// part of the name or email address, in any case
+	Query string
+	Role  string
+	// only the disabled users, or only the ones that aren't
+	Disabled *bool
+}
+
+// UserPageRequest describes one page of users, in the order they signed
+// up. like the movies we page with a cursor rather than an offset: the
+// page starts right after the user with id After
+type UserPageRequest struct {
+	Filter UserFilter
+	First  int
+	After  int
+}
+
+// UserPage is what the repository gives back for a UserPageRequest
+type UserPage struct {
+	Users       []*User
+	HasNextPage bool
+}
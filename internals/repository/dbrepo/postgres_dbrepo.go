@@ -2,16 +2,24 @@ package dbrepo
 
 import (
 	"backend/internals/models"
+	"backend/internals/repository"
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 	"time"
+
+	"github.com/jackc/pgconn"
 )
 
 type PostgresDBRepo struct {
 	DB *sql.DB // holds connections to the database
+
+	// the context of the request we're working for, see WithContext
+	ctx context.Context
 }
 
 const dbTimeout = time.Second * 3 // I'm going to give you 3 seconds to interact with the database
@@ -21,13 +29,28 @@ func (m *PostgresDBRepo) Connection() *sql.DB {
 	return m.DB
 }
 
+// WithContext gives back a repository whose queries belong to ctx: they're
+// cancelled when the request is, and what they log carries its request id
+func (m *PostgresDBRepo) WithContext(ctx context.Context) repository.DatabaseRepo {
+	return &PostgresDBRepo{DB: m.DB, ctx: ctx}
+}
+
+// baseContext is what every query's timeout is built on
+func (m *PostgresDBRepo) baseContext() context.Context {
+	if m.ctx != nil {
+		return m.ctx
+	}
+	return context.Background()
+}
+
 func (m *PostgresDBRepo) AllMovie(genre ...int) ([]*models.Movie, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
 	defer cancel()
 
-	where := ""
+	// movies in the trash are never shown
+	where := "where deleted_at is null"
 	if len(genre) > 0 {
-		where = fmt.Sprintf("where id in (select movie_id from movies_genres where genre_id = %d)", genre[0])
+		where += fmt.Sprintf(" and id in (select movie_id from movies_genres where genre_id = %d)", genre[0])
 	}
 
 	// lets write some SQL that will connect to the database and
@@ -44,7 +67,7 @@ func (m *PostgresDBRepo) AllMovie(genre ...int) ([]*models.Movie, error) {
 	`, where)
 	rows, err := m.DB.QueryContext(ctx, query)
 	if err != nil {
-		log.Println(err)
+		slog.ErrorContext(ctx, "failed to list movies", "err", err)
 		return nil, err
 	}
 	// close the rows when you're done with them
@@ -78,14 +101,49 @@ func (m *PostgresDBRepo) AllMovie(genre ...int) ([]*models.Movie, error) {
 	return movies, nil
 }
 
+// Ping checks that we can still reach the database
+func (m *PostgresDBRepo) Ping() error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	return m.DB.PingContext(ctx)
+}
+
+// SchemaVersion is the version of the database schema, and whether the
+// last change to it failed half way (dirty)
+func (m *PostgresDBRepo) SchemaVersion() (int, bool, error) {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	query := `select version, dirty from schema_migrations order by version desc limit 1`
+
+	var version int
+	var dirty bool
+	err := m.DB.QueryRowContext(ctx, query).Scan(&version, &dirty)
+	return version, dirty, err
+}
+
+// MoviesLastModified is when the list of movies last changed: the latest
+// time a movie was added, changed or moved to the trash
+func (m *PostgresDBRepo) MoviesLastModified() (time.Time, error) {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	query := `select coalesce(max(greatest(updated_at, deleted_at)), 'epoch') from movies`
+
+	var lastModified time.Time
+	err := m.DB.QueryRowContext(ctx, query).Scan(&lastModified)
+	return lastModified, err
+}
+
 // to get movies that are being displayed to the public
 func (m *PostgresDBRepo) OneMovie(id int) (*models.Movie, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
 	defer cancel()
 
 	query := `select id, title, release_date, runtime, mpaa_rating,
 		description, coalesce(image, ''), created_at, updated_at
-		from movies where id = $1`
+		from movies where id = $1 and deleted_at is null`
 
 	row := m.DB.QueryRowContext(ctx, query, id)
 
@@ -138,12 +196,12 @@ func (m *PostgresDBRepo) OneMovie(id int) (*models.Movie, error) {
 }
 
 func (m *PostgresDBRepo) OneMovieForEdit(id int) (*models.Movie, []*models.Genre, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
 	defer cancel()
 
 	query := `select id, title, release_date, runtime, mpaa_rating,
 		description, coalesce(image, ''), created_at, updated_at
-		from movies where id = $1`
+		from movies where id = $1 and deleted_at is null`
 
 	row := m.DB.QueryRowContext(ctx, query, id)
 
@@ -220,13 +278,17 @@ func (m *PostgresDBRepo) OneMovieForEdit(id int) (*models.Movie, []*models.Genre
 }
 
 func (m *PostgresDBRepo) GetUserByEmail(email string) (*models.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
 	defer cancel()
 
 	query := `select id, email, first_name, last_name, password,
-				created_at, updated_at from users where email = $1`
+				created_at, updated_at, token_version, email_verified_at, role,
+				totp_secret, totp_enabled_at, totp_last_step, disabled_at,
+				password_change_required from users where lower(email) = lower($1)`
 
 	var user models.User
+	var verifiedAt, totpEnabledAt, disabledAt sql.NullTime
+	var totpSecret sql.NullString
 	row := m.DB.QueryRowContext(ctx, query, email)
 
 	err := row.Scan(
@@ -237,20 +299,42 @@ func (m *PostgresDBRepo) GetUserByEmail(email string) (*models.User, error) {
 		&user.Password,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.TokenVersion,
+		&verifiedAt,
+		&user.Role,
+		&totpSecret,
+		&totpEnabledAt,
+		&user.TOTPLastStep,
+		&disabledAt,
+		&user.PasswordChangeRequired,
 	)
 	if err != nil {
 		return nil, err
 	}
+	if verifiedAt.Valid {
+		user.EmailVerifiedAt = &verifiedAt.Time
+	}
+	user.TOTPSecret = totpSecret.String
+	if totpEnabledAt.Valid {
+		user.TOTPEnabledAt = &totpEnabledAt.Time
+	}
+	if disabledAt.Valid {
+		user.DisabledAt = &disabledAt.Time
+	}
 	return &user, nil
 }
 
 func (m *PostgresDBRepo) GetUserByID(id int) (*models.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
 	defer cancel()
 	query := `select id, email, first_name, last_name, password,
-				created_at, updated_at from users where id = $1`
+				created_at, updated_at, token_version, email_verified_at, role,
+				totp_secret, totp_enabled_at, totp_last_step, disabled_at,
+				password_change_required from users where id = $1`
 
 	var user models.User
+	var verifiedAt, totpEnabledAt, disabledAt sql.NullTime
+	var totpSecret sql.NullString
 	row := m.DB.QueryRowContext(ctx, query, id)
 
 	err := row.Scan(
@@ -261,15 +345,33 @@ func (m *PostgresDBRepo) GetUserByID(id int) (*models.User, error) {
 		&user.Password,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.TokenVersion,
+		&verifiedAt,
+		&user.Role,
+		&totpSecret,
+		&totpEnabledAt,
+		&user.TOTPLastStep,
+		&disabledAt,
+		&user.PasswordChangeRequired,
 	)
 	if err != nil {
 		return nil, err
 	}
+	if verifiedAt.Valid {
+		user.EmailVerifiedAt = &verifiedAt.Time
+	}
+	user.TOTPSecret = totpSecret.String
+	if totpEnabledAt.Valid {
+		user.TOTPEnabledAt = &totpEnabledAt.Time
+	}
+	if disabledAt.Valid {
+		user.DisabledAt = &disabledAt.Time
+	}
 	return &user, nil
 }
 
 func (m *PostgresDBRepo) AllGenres() ([]*models.Genre, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
 	defer cancel()
 
 	query := `select id, genre, created_at, updated_at from genres order by genre`
@@ -300,7 +402,7 @@ func (m *PostgresDBRepo) AllGenres() ([]*models.Genre, error) {
 }
 
 func (m *PostgresDBRepo) InsertMovie(movie models.Movie) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
 	defer cancel()
 
 	stmt := `insert into movies (title, description, release_date, runtime,
@@ -320,22 +422,24 @@ func (m *PostgresDBRepo) InsertMovie(movie models.Movie) (int, error) {
 		movie.Image).Scan(&newID)
 
 	if err != nil {
-		log.Println(err)
+		slog.ErrorContext(ctx, "failed to insert movie", "err", err)
 		return 0, err
 	}
 
 	return newID, nil
 }
 
-func (m *PostgresDBRepo) UpdateMovie(movie models.Movie) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// UpdateMovie saves movie. version is the updated_at the caller saw, the
+// movie is only changed when it still has it, otherwise it's
+// repository.ErrMovieChanged. the zero time changes it whatever it is now
+func (m *PostgresDBRepo) UpdateMovie(movie models.Movie, version time.Time) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
 	defer cancel()
 
 	stmt := `update movies set title = $1, description = $2, release_date = $3, 
 			runtime = $4, mpaa_rating = $5, updated_at = $6, image = $7 
 			where id = $8`
-
-	_, err := m.DB.ExecContext(ctx, stmt,
+	args := []interface{}{
 		movie.Title,
 		movie.Description,
 		movie.ReleaseDate,
@@ -344,17 +448,32 @@ func (m *PostgresDBRepo) UpdateMovie(movie models.Movie) error {
 		movie.UpdateAt,
 		movie.Image,
 		movie.ID,
-	)
+	}
+	if !version.IsZero() {
+		// checked in the same statement that writes, so two editors who
+		// saw the same version can't both get through
+		stmt += ` and updated_at = $9::timestamp`
+		args = append(args, version)
+	}
+
+	result, err := m.DB.ExecContext(ctx, stmt, args...)
 	if err != nil {
 		return err
 	}
+	if !version.IsZero() {
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return repository.ErrMovieChanged
+		}
+	}
 
 	return nil
 
 }
 
 func (m *PostgresDBRepo) UpdateMovieGenre(id int, genresIDs []int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
 	defer cancel()
 
 	// the easy way to do this is to delete from the table
@@ -378,21 +497,1581 @@ func (m *PostgresDBRepo) UpdateMovieGenre(id int, genresIDs []int) error {
 	return nil
 }
 
-func (m *PostgresDBRepo) DeleteMovie(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// DeleteMovie moves a movie to the trash. the row (and its genres) stays
+// in the database with deleted_at set, and every query that shows movies
+// skips it, until it's restored or purged for good. like UpdateMovie it
+// only deletes the version the caller saw, unless version is the zero time
+func (m *PostgresDBRepo) DeleteMovie(id int, version time.Time) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	stmt := `update movies set deleted_at = $1 where id = $2 and deleted_at is null`
+	args := []interface{}{time.Now(), id}
+	if !version.IsZero() {
+		stmt += ` and updated_at = $3::timestamp`
+		args = append(args, version)
+	}
+
+	result, err := m.DB.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+	err = expectOneRow(result)
+	if errors.Is(err, sql.ErrNoRows) && !version.IsZero() {
+		return repository.ErrMovieChanged
+	}
+	return err
+}
+
+// TrashedMovies lists the movies that are in the trash, most recently
+// deleted first
+func (m *PostgresDBRepo) TrashedMovies() ([]*models.Movie, error) {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	query := `
+		select
+			id, title, release_date, runtime,
+			mpaa_rating, description, coalesce(image, ''),
+			created_at, updated_at, deleted_at
+		from
+			movies
+		where
+			deleted_at is not null
+		order by
+			deleted_at desc
+	`
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var movies []*models.Movie
+	for rows.Next() {
+		var movie models.Movie
+		err := rows.Scan(
+			&movie.ID,
+			&movie.Title,
+			&movie.ReleaseDate,
+			&movie.RunTime,
+			&movie.MPAARating,
+			&movie.Description,
+			&movie.Image,
+			&movie.CreatedAt,
+			&movie.UpdateAt,
+			&movie.DeletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		movies = append(movies, &movie)
+	}
+
+	return movies, rows.Err()
+}
+
+// RestoreFromTrash takes a movie back out of the trash
+func (m *PostgresDBRepo) RestoreFromTrash(id int) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	// coming back counts as a change, so Last-Modified of the list moves on
+	stmt := `update movies set deleted_at = null, updated_at = $1
+			where id = $2 and deleted_at is not null`
+
+	result, err := m.DB.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+// PurgeMovie deletes a movie that's in the trash for good
+func (m *PostgresDBRepo) PurgeMovie(id int) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
 	defer cancel()
 
-	// delete the movie from the movies
-	stmt := `delete from movies where id = $1`
 	// we don't have to delete the genres because in the database
 	// we have the genres setup with movies table with foreign key relations
 	// so when we delete a movie it's genres gets deleted automatically
+	stmt := `delete from movies where id = $1 and deleted_at is not null`
 
-	_, err := m.DB.ExecContext(ctx, stmt, id)
+	result, err := m.DB.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+// PurgeTrash deletes for good every movie that went into the trash before
+// the given time, and returns their ids
+func (m *PostgresDBRepo) PurgeTrash(deletedBefore time.Time) ([]int, error) {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from movies where deleted_at is not null and deleted_at < $1 returning id`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, deletedBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// expectOneRow turns "nothing matched" into sql.ErrNoRows, so callers can
+// tell a missing movie apart from one that was changed
+func expectOneRow(result sql.Result) error {
+	n, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
-	s := `some text,`
-	s = strings.TrimRight(s, ",")
+	if n == 0 {
+		return sql.ErrNoRows
+	}
 	return nil
 }
+
+// MoviesPage returns one page of movies using keyset pagination.
+// instead of "offset 40 limit 20" (which gets slower the deeper you go and
+// skips/duplicates rows when the table changes) we remember the sort value
+// and id of the last movie we've seen and ask for the rows that come after it
+func (m *PostgresDBRepo) MoviesPage(page models.MoviePageRequest) (*models.MoviePage, error) {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	sortColumn, ok := movieSortColumns[page.SortField]
+	if !ok {
+		sortColumn = movieSortColumns[models.SortByTitle]
+	}
+
+	// movies in the trash are never shown
+	where := []string{"deleted_at is null"}
+	var args []interface{}
+	// arg adds a value to the argument list and gives back its placeholder
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	where = append(where, filterConditions(page.Filter, arg)...)
+
+	// "after" means further along in the order we're sorting by,
+	// so for a descending sort it's a smaller value, not a bigger one
+	afterOp, beforeOp := ">", "<"
+	if page.Descending {
+		afterOp, beforeOp = "<", ">"
+	}
+	if page.After != nil {
+		where = append(where, fmt.Sprintf("(%s, id) %s (%s, %s)", sortColumn, afterOp, arg(page.After.Value), arg(page.After.ID)))
+	}
+	if page.Before != nil {
+		where = append(where, fmt.Sprintf("(%s, id) %s (%s, %s)", sortColumn, beforeOp, arg(page.Before.Value), arg(page.Before.ID)))
+	}
+
+	// when paging backwards we read the rows in reverse order, closest to
+	// the "before" cursor first, and flip them around once we have them
+	backward := page.Last > 0 && page.First == 0
+	limit := page.First
+	descending := page.Descending
+	if backward {
+		limit = page.Last
+		descending = !descending
+	}
+	direction := "asc"
+	if descending {
+		direction = "desc"
+	}
+
+	whereClause := "where " + strings.Join(where, " and ")
+
+	// we ask for one more row than we need, if we get it there's another page
+	query := fmt.Sprintf(`
+		select
+			id, title, release_date, runtime,
+			mpaa_rating, description, coalesce(image, ''),
+			created_at, updated_at
+		from
+			movies %s
+		order by
+			%s %s, id %s
+		limit %s
+	`, whereClause, sortColumn, direction, direction, arg(limit+1))
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var movies []*models.Movie
+	for rows.Next() {
+		var movie models.Movie
+		err := rows.Scan(
+			&movie.ID,
+			&movie.Title,
+			&movie.ReleaseDate,
+			&movie.RunTime,
+			&movie.MPAARating,
+			&movie.Description,
+			&movie.Image,
+			&movie.CreatedAt,
+			&movie.UpdateAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		movies = append(movies, &movie)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	more := len(movies) > limit
+	if more {
+		movies = movies[:limit]
+	}
+
+	var result models.MoviePage
+	if backward {
+		for i, j := 0, len(movies)-1; i < j; i, j = i+1, j-1 {
+			movies[i], movies[j] = movies[j], movies[i]
+		}
+		result.HasPreviousPage = more
+		result.HasNextPage = page.Before != nil
+	} else {
+		result.HasNextPage = more
+		result.HasPreviousPage = page.After != nil
+	}
+	result.Movies = movies
+
+	return &result, nil
+}
+
+// filterConditions turns a MovieFilter into where conditions, arg adds a
+// value to the query's arguments and returns its placeholder
+func filterConditions(f models.MovieFilter, arg func(v interface{}) string) []string {
+	var where []string
+	if f.TitleContains != "" {
+		where = append(where, "title ilike "+arg("%"+escapeLike(f.TitleContains)+"%"))
+	}
+	if f.GenreID > 0 {
+		where = append(where, "id in (select movie_id from movies_genres where genre_id = "+arg(f.GenreID)+")")
+	}
+	if len(f.MPAARatings) > 0 {
+		where = append(where, "mpaa_rating = any("+arg(f.MPAARatings)+")")
+	}
+	if f.YearFrom > 0 {
+		where = append(where, "extract(year from release_date) >= "+arg(f.YearFrom))
+	}
+	if f.YearTo > 0 {
+		where = append(where, "extract(year from release_date) <= "+arg(f.YearTo))
+	}
+	if !f.UpdatedSince.IsZero() {
+		where = append(where, "updated_at >= "+arg(f.UpdatedSince))
+	}
+	return where
+}
+
+// only these columns can ever end up in an order by clause
+var movieSortColumns = map[models.MovieSortField]string{
+	models.SortByTitle:       "title",
+	models.SortByReleaseDate: "release_date",
+	models.SortByRuntime:     "runtime",
+	models.SortByCreatedAt:   "created_at",
+}
+
+// escapeLike makes sure % and _ typed by the user are searched for literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// RestoreMovie puts back a movie that was deleted, keeping its old id
+// so links to it keep working
+func (m *PostgresDBRepo) RestoreMovie(movie models.Movie) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	// the id column is "generated always", so we have to tell postgres
+	// we really do want to pick the id ourselves
+	stmt := `insert into movies (id, title, description, release_date, runtime,
+			mpaa_rating, created_at, updated_at, image)
+			overriding system value
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		movie.ID,
+		movie.Title,
+		movie.Description,
+		movie.ReleaseDate,
+		movie.RunTime,
+		movie.MPAARating,
+		movie.CreatedAt,
+		movie.UpdateAt,
+		movie.Image,
+	)
+	return err
+}
+
+func (m *PostgresDBRepo) InsertAuditEntry(entry models.AuditEntry) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	changes, err := json.Marshal(entry.Changes)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into movie_audit (movie_id, user_id, action, before, after,
+			changes, created_at) values ($1, $2, $3, $4::jsonb, $5::jsonb,
+			$6::jsonb, $7)`
+
+	_, err = m.DB.ExecContext(ctx, stmt,
+		entry.MovieID,
+		nullInt(entry.UserID),
+		entry.Action,
+		nullJSON(entry.Before),
+		nullJSON(entry.After),
+		string(changes),
+		entry.CreatedAt,
+	)
+	return err
+}
+
+// MovieHistory returns every change made to a movie, newest first
+func (m *PostgresDBRepo) MovieHistory(movieID int) ([]*models.AuditEntry, error) {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	query := `select id, movie_id, coalesce(user_id, 0), action, before, after,
+			changes, created_at from movie_audit where movie_id = $1
+			order by created_at desc, id desc`
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*models.AuditEntry
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+func (m *PostgresDBRepo) GetAuditEntry(id int) (*models.AuditEntry, error) {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	query := `select id, movie_id, coalesce(user_id, 0), action, before, after,
+			changes, created_at from movie_audit where id = $1`
+
+	return scanAuditEntry(m.DB.QueryRowContext(ctx, query, id))
+}
+
+// scanner is what *sql.Row and *sql.Rows have in common
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAuditEntry(row scanner) (*models.AuditEntry, error) {
+	var entry models.AuditEntry
+	var before, after, changes []byte
+
+	err := row.Scan(
+		&entry.ID,
+		&entry.MovieID,
+		&entry.UserID,
+		&entry.Action,
+		&before,
+		&after,
+		&changes,
+		&entry.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.Before = before
+	entry.After = after
+	if len(changes) > 0 {
+		if err := json.Unmarshal(changes, &entry.Changes); err != nil {
+			return nil, err
+		}
+	}
+
+	return &entry, nil
+}
+
+// nullInt stores 0 as null, for optional foreign keys
+func nullInt(n int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(n), Valid: n != 0}
+}
+
+// nullJSON stores an empty JSON value as null
+func nullJSON(raw []byte) sql.NullString {
+	return sql.NullString{String: string(raw), Valid: len(raw) > 0}
+}
+
+// ImportMovies creates or updates every row in a single transaction.
+// a row matches an existing movie by its external id, or failing that by
+// title and release year. each row gets its own savepoint, so one bad row
+// doesn't stop us from trying (and reporting on) the rest.
+// we only commit when commit is true, and when atomic is true only if
+// every row worked. the second return value says whether we committed
+func (m *PostgresDBRepo) ImportMovies(rows []models.MovieImportRow, commit, atomic bool) ([]models.ImportResult, bool, error) {
+	ctx, cancel := context.WithTimeout(m.baseContext(), repository.ImportTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	// does nothing once we've committed
+	defer tx.Rollback()
+
+	results := make([]models.ImportResult, 0, len(rows))
+	failed := false
+
+	for _, row := range rows {
+		result := models.ImportResult{Line: row.Line, Title: row.Title}
+
+		if _, err := tx.ExecContext(ctx, "savepoint import_row"); err != nil {
+			return nil, false, err
+		}
+
+		id, before, err := importMovie(ctx, tx, row)
+		if err != nil {
+			if _, rbErr := tx.ExecContext(ctx, "rollback to savepoint import_row"); rbErr != nil {
+				return nil, false, rbErr
+			}
+			failed = true
+			result.Status = models.ImportFailed
+			result.Errors = []string{err.Error()}
+		} else {
+			if _, err := tx.ExecContext(ctx, "release savepoint import_row"); err != nil {
+				return nil, false, err
+			}
+			result.MovieID = id
+			result.Status = models.ImportCreated
+			if before != nil {
+				result.Status = models.ImportUpdated
+				result.Before = before
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	if !commit || (atomic && failed) {
+		return results, false, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	return results, true, nil
+}
+
+// importMovie upserts one row inside the import transaction. when it
+// updated a movie it gives back how the movie looked before, nil means it
+// created a new one
+func importMovie(ctx context.Context, tx *sql.Tx, row models.MovieImportRow) (int, *models.Movie, error) {
+	now := time.Now()
+
+	var id int
+	err := sql.ErrNoRows
+	if row.ExternalID != "" {
+		// external ids are unique in the trash too, a movie there keeps
+		// its id in case it's restored
+		var trashed bool
+		err = tx.QueryRowContext(ctx, `select id, deleted_at is not null from movies
+			where external_id = $1`, row.ExternalID).Scan(&id, &trashed)
+		if err == nil && trashed {
+			return 0, nil, fmt.Errorf("the movie with external_id %s is in the trash, restore or purge it first", row.ExternalID)
+		}
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		// a movie that has no external id yet is the better match, one
+		// with a different external id is a different film of the same
+		// name (a remake), the row mustn't take it over
+		var externalID sql.NullString
+		err = tx.QueryRowContext(ctx, `select id, external_id from movies
+			where lower(title) = lower($1)
+			and extract(year from release_date) = $2
+			and deleted_at is null
+			order by external_id is null desc, id limit 1`, row.Title, row.ReleaseDate.Year()).Scan(&id, &externalID)
+		if err == nil && row.ExternalID != "" && externalID.Valid && externalID.String != row.ExternalID {
+			return 0, nil, fmt.Errorf("movie %d has the same title and year but external_id %s, not %s", id, externalID.String, row.ExternalID)
+		}
+	}
+
+	var before *models.Movie
+	switch {
+	case err == nil:
+		before, err = importSnapshot(ctx, tx, id)
+		if err != nil {
+			return 0, nil, err
+		}
+		_, err = tx.ExecContext(ctx, `update movies set title = $1, description = $2,
+			release_date = $3, runtime = $4, mpaa_rating = $5, updated_at = $6,
+			external_id = coalesce(nullif($7, ''), external_id)
+			where id = $8`,
+			row.Title, row.Description, row.ReleaseDate, row.RunTime,
+			row.MPAARating, now, row.ExternalID, id)
+	case errors.Is(err, sql.ErrNoRows):
+		err = tx.QueryRowContext(ctx, `insert into movies (title, description,
+			release_date, runtime, mpaa_rating, created_at, updated_at, external_id)
+			values ($1, $2, $3, $4, $5, $6, $7, nullif($8, '')) returning id`,
+			row.Title, row.Description, row.ReleaseDate, row.RunTime,
+			row.MPAARating, now, now, row.ExternalID).Scan(&id)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// replace the genres, same as UpdateMovieGenre does
+	_, err = tx.ExecContext(ctx, `delete from movies_genres where movie_id = $1`, id)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, genreID := range row.GenreIDs {
+		_, err = tx.ExecContext(ctx, `insert into movies_genres (movie_id, genre_id) values ($1, $2)`, id, genreID)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return id, before, nil
+}
+
+// importSnapshot reads a movie the way the audit trail keeps it (the
+// fields OneMovie has, genre ids instead of genres) and locks it until
+// the import is done
+func importSnapshot(ctx context.Context, tx *sql.Tx, id int) (*models.Movie, error) {
+	var movie models.Movie
+	err := tx.QueryRowContext(ctx, `select id, title, release_date, runtime, mpaa_rating,
+			description, coalesce(image, ''), created_at, updated_at
+		from movies where id = $1 for update`, id).Scan(
+		&movie.ID,
+		&movie.Title,
+		&movie.ReleaseDate,
+		&movie.RunTime,
+		&movie.MPAARating,
+		&movie.Description,
+		&movie.Image,
+		&movie.CreatedAt,
+		&movie.UpdateAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `select genre_id from movies_genres
+		where movie_id = $1 order by genre_id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movie.GenresArray = []int{}
+	for rows.Next() {
+		var genreID int
+		if err := rows.Scan(&genreID); err != nil {
+			return nil, err
+		}
+		movie.GenresArray = append(movie.GenresArray, genreID)
+	}
+	return &movie, rows.Err()
+}
+
+// an export walks the whole catalog, it gets a lot longer than dbTimeout
+const exportTimeout = 5 * time.Minute
+
+// ExportMovies reads every movie that matches the filter, with its genres,
+// and hands them to fn one at a time as they come off the wire. we never
+// hold more than one movie in memory, so this works for any size catalog.
+// if fn returns an error we stop and return it
+func (m *PostgresDBRepo) ExportMovies(filter models.MovieFilter, fn func(movie *models.Movie) error) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), exportTimeout)
+	defer cancel()
+
+	where := []string{"deleted_at is null"}
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	where = append(where, filterConditions(filter, arg)...)
+
+	// the genres come along as a JSON array, so we get everything
+	// in one pass instead of a query per movie
+	query := fmt.Sprintf(`
+		select
+			m.id, coalesce(m.external_id, ''), m.title, m.release_date, m.runtime,
+			m.mpaa_rating, m.description, coalesce(m.image, ''),
+			m.created_at, m.updated_at,
+			coalesce((
+				select json_agg(json_build_object('id', g.id, 'genre', g.genre) order by g.genre)
+				from movies_genres mg join genres g on (mg.genre_id = g.id)
+				where mg.movie_id = m.id
+			), '[]')
+		from
+			movies m
+		where
+			%s
+		order by
+			m.id
+	`, strings.Join(where, " and "))
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var movie models.Movie
+		var genres []byte
+		err := rows.Scan(
+			&movie.ID,
+			&movie.ExternalID,
+			&movie.Title,
+			&movie.ReleaseDate,
+			&movie.RunTime,
+			&movie.MPAARating,
+			&movie.Description,
+			&movie.Image,
+			&movie.CreatedAt,
+			&movie.UpdateAt,
+			&genres,
+		)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(genres, &movie.Genres); err != nil {
+			return err
+		}
+
+		if err := fn(&movie); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// ReserveIdempotencyKey claims a key for a request. if the key is new it
+// is stored (with no response yet) and the second return value is true.
+// if someone already used it we get back what was stored for it
+func (m *PostgresDBRepo) ReserveIdempotencyKey(key string, userID int, requestHash string) (*models.IdempotencyRecord, bool, error) {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	// "on conflict do nothing" means only one of two identical requests
+	// arriving at the same time gets the key
+	stmt := `insert into idempotency_keys (key, user_id, request_hash, created_at)
+			values ($1, $2, $3, $4) on conflict (user_id, key) do nothing`
+
+	result, err := m.DB.ExecContext(ctx, stmt, key, userID, requestHash, time.Now())
+	if err != nil {
+		return nil, false, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return nil, false, err
+	} else if n == 1 {
+		return &models.IdempotencyRecord{Key: key, UserID: userID, RequestHash: requestHash}, true, nil
+	}
+
+	query := `select key, user_id, request_hash, coalesce(status_code, 0),
+			response_headers, response_body, created_at
+			from idempotency_keys where user_id = $1 and key = $2`
+
+	var record models.IdempotencyRecord
+	var header []byte
+	err = m.DB.QueryRowContext(ctx, query, userID, key).Scan(
+		&record.Key,
+		&record.UserID,
+		&record.RequestHash,
+		&record.StatusCode,
+		&header,
+		&record.Body,
+		&record.CreatedAt,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(header) > 0 {
+		if err := json.Unmarshal(header, &record.Header); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return &record, false, nil
+}
+
+// CompleteIdempotencyKey stores the response we gave for a key
+func (m *PostgresDBRepo) CompleteIdempotencyKey(record models.IdempotencyRecord) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	header, err := json.Marshal(record.Header)
+	if err != nil {
+		return err
+	}
+
+	stmt := `update idempotency_keys set status_code = $1, response_headers = $2::jsonb,
+			response_body = $3 where user_id = $4 and key = $5`
+
+	_, err = m.DB.ExecContext(ctx, stmt, record.StatusCode, string(header), record.Body, record.UserID, record.Key)
+	return err
+}
+
+// ReleaseIdempotencyKey forgets a key, so the request can be tried again
+func (m *PostgresDBRepo) ReleaseIdempotencyKey(key string, userID int) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from idempotency_keys where user_id = $1 and key = $2`, userID, key)
+	return err
+}
+
+// DeleteIdempotencyKeys forgets keys that are older than we promise to
+// remember them for
+func (m *PostgresDBRepo) DeleteIdempotencyKeys(createdBefore time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `delete from idempotency_keys where created_at < $1`, createdBefore)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// UpdateRateLimitBucket hands the bucket of key to update and stores what
+// it did with it. the row is locked while update runs, so two requests
+// can't both take the last token
+func (m *PostgresDBRepo) UpdateRateLimitBucket(key string, update func(bucket *models.RateLimitBucket) error) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	bucket := models.RateLimitBucket{Key: key}
+	query := `select tokens, updated_at from rate_limits where key = $1 for update`
+	err = tx.QueryRowContext(ctx, query, key).Scan(&bucket.Tokens, &bucket.UpdatedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if err := update(&bucket); err != nil {
+		return err
+	}
+
+	// a new key can't be locked before it's there, when two requests
+	// create it at the same time the last one wins. that costs a token at
+	// most
+	stmt := `insert into rate_limits (key, tokens, updated_at) values ($1, $2, $3)
+			on conflict (key) do update set tokens = excluded.tokens, updated_at = excluded.updated_at`
+	if _, err := tx.ExecContext(ctx, stmt, key, bucket.Tokens, bucket.UpdatedAt); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetLoginFailures gives back the failed logins of key, no rows is no
+// failures
+func (m *PostgresDBRepo) GetLoginFailures(key string) (*models.LoginFailures, error) {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	failures, err := scanLoginFailures(m.DB.QueryRowContext(ctx,
+		`select failures, last_failure_at, locked_until from login_failures where key = $1`, key), key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &models.LoginFailures{Key: key}, nil
+	}
+	return failures, err
+}
+
+// UpdateLoginFailures hands the failed logins of key to update and stores
+// what it did with them, with the row locked in between
+func (m *PostgresDBRepo) UpdateLoginFailures(key string, update func(failures *models.LoginFailures) error) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	failures, err := scanLoginFailures(tx.QueryRowContext(ctx,
+		`select failures, last_failure_at, locked_until from login_failures where key = $1 for update`, key), key)
+	if errors.Is(err, sql.ErrNoRows) {
+		failures, err = &models.LoginFailures{Key: key}, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := update(failures); err != nil {
+		return err
+	}
+
+	var lockedUntil sql.NullTime
+	if !failures.LockedUntil.IsZero() {
+		lockedUntil = sql.NullTime{Time: failures.LockedUntil, Valid: true}
+	}
+	stmt := `insert into login_failures (key, failures, last_failure_at, locked_until) values ($1, $2, $3, $4)
+			on conflict (key) do update set failures = excluded.failures,
+			last_failure_at = excluded.last_failure_at, locked_until = excluded.locked_until`
+	if _, err := tx.ExecContext(ctx, stmt, key, failures.Failures, failures.LastFailureAt, lockedUntil); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func scanLoginFailures(row scanner, key string) (*models.LoginFailures, error) {
+	failures := models.LoginFailures{Key: key}
+	var lockedUntil sql.NullTime
+	if err := row.Scan(&failures.Failures, &failures.LastFailureAt, &lockedUntil); err != nil {
+		return nil, err
+	}
+	failures.LockedUntil = lockedUntil.Time
+	return &failures, nil
+}
+
+// DeleteLoginFailures forgets the failed logins of key, after it logged in
+func (m *PostgresDBRepo) DeleteLoginFailures(key string) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from login_failures where key = $1`, key)
+	return err
+}
+
+// PurgeRateLimits forgets the buckets that have been full since before
+// bucketsBefore, and the failed logins whose last failure (or lock, when
+// that ran out later) was before failuresBefore
+func (m *PostgresDBRepo) PurgeRateLimits(bucketsBefore, failuresBefore time.Time) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	if _, err := m.DB.ExecContext(ctx, `delete from rate_limits where updated_at < $1`, bucketsBefore); err != nil {
+		return err
+	}
+
+	stmt := `delete from login_failures
+			where greatest(last_failure_at, locked_until) < $1`
+	_, err := m.DB.ExecContext(ctx, stmt, failuresBefore)
+	return err
+}
+
+// CreatePasswordReset stores a new reset token. the tokens the user asked
+// for before and didn't use stop working, only the latest email counts
+func (m *PostgresDBRepo) CreatePasswordReset(reset models.PasswordReset) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from password_resets where user_id = $1 and used_at is null`, reset.UserID)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into password_resets (token_hash, user_id, expires_at, created_at)
+			values ($1, $2, $3, $4)`
+	_, err = tx.ExecContext(ctx, stmt, reset.TokenHash, reset.UserID, reset.ExpiresAt, reset.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetPasswordReset finds a reset token that can still be used, a token
+// that's used or expired is sql.ErrNoRows like one that never existed
+func (m *PostgresDBRepo) GetPasswordReset(tokenHash string) (*models.PasswordReset, error) {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	query := `select token_hash, user_id, expires_at, used_at, created_at
+			from password_resets where token_hash = $1 and used_at is null and expires_at > now()`
+
+	var reset models.PasswordReset
+	var usedAt sql.NullTime
+	err := m.DB.QueryRowContext(ctx, query, tokenHash).Scan(
+		&reset.TokenHash,
+		&reset.UserID,
+		&reset.ExpiresAt,
+		&usedAt,
+		&reset.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if usedAt.Valid {
+		reset.UsedAt = &usedAt.Time
+	}
+	return &reset, nil
+}
+
+// ResetPassword uses up a reset token and gives its user passwordHash as
+// their password. their token version goes up too, which logs them out
+// everywhere. when somebody used the token first it's sql.ErrNoRows
+func (m *PostgresDBRepo) ResetPassword(tokenHash, passwordHash string) (int, error) {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// only one of two requests with the same token gets a row back here
+	stmt := `update password_resets set used_at = now()
+			where token_hash = $1 and used_at is null and expires_at > now()
+			returning user_id`
+	var userID int
+	if err := tx.QueryRowContext(ctx, stmt, tokenHash).Scan(&userID); err != nil {
+		return 0, err
+	}
+
+	stmt = `update users set password = $1, token_version = token_version + 1,
+				password_change_required = false, updated_at = $2
+			where id = $3`
+	result, err := tx.ExecContext(ctx, stmt, passwordHash, time.Now(), userID)
+	if err != nil {
+		return 0, err
+	}
+	if err := expectOneRow(result); err != nil {
+		return 0, err
+	}
+
+	// and any other link we mailed them doesn't work either
+	_, err = tx.ExecContext(ctx, `delete from password_resets where user_id = $1 and used_at is null`, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, tx.Commit()
+}
+
+// DeletePasswordResets forgets reset tokens that expired before
+// expiredBefore, used or not
+func (m *PostgresDBRepo) DeletePasswordResets(expiredBefore time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `delete from password_resets where expires_at < $1`, expiredBefore)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// CreateEmailVerification stores a new verification token, the ones we
+// mailed the user before stop working
+func (m *PostgresDBRepo) CreateEmailVerification(verification models.EmailVerification) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from email_verifications where user_id = $1`, verification.UserID)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into email_verifications (token_hash, user_id, email, expires_at, created_at)
+			values ($1, $2, $3, $4, $5)`
+	_, err = tx.ExecContext(ctx, stmt, verification.TokenHash, verification.UserID,
+		verification.Email, verification.ExpiresAt, verification.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// VerifyEmail uses up a verification token and marks the address it was
+// mailed to as verified. a token that's expired, used, or for an address
+// the user doesn't have any more is sql.ErrNoRows
+func (m *PostgresDBRepo) VerifyEmail(tokenHash string) (int, error) {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt := `delete from email_verifications
+			where token_hash = $1 and expires_at > now()
+			returning user_id, email`
+	var userID int
+	var email string
+	if err := tx.QueryRowContext(ctx, stmt, tokenHash).Scan(&userID, &email); err != nil {
+		return 0, err
+	}
+
+	// verifying twice keeps the time of the first
+	stmt = `update users set email_verified_at = coalesce(email_verified_at, now()), updated_at = $1
+			where id = $2 and email = $3`
+	result, err := tx.ExecContext(ctx, stmt, time.Now(), userID, email)
+	if err != nil {
+		return 0, err
+	}
+	if err := expectOneRow(result); err != nil {
+		return 0, err
+	}
+
+	return userID, tx.Commit()
+}
+
+// DeleteEmailVerifications forgets verification tokens that expired
+// before expiredBefore
+func (m *PostgresDBRepo) DeleteEmailVerifications(expiredBefore time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `delete from email_verifications where expires_at < $1`, expiredBefore)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// SetPendingTOTP gives the user a new TOTP secret to confirm. once TOTP is
+// enabled the secret can't change, that's sql.ErrNoRows
+func (m *PostgresDBRepo) SetPendingTOTP(userID int, secret string) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set totp_secret = $1, updated_at = $2
+			where id = $3 and totp_enabled_at is null`
+	result, err := m.DB.ExecContext(ctx, stmt, secret, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+// EnableTOTP turns on TOTP for the user with the secret they confirmed
+// with a code for step, and stores the hashes of their recovery codes.
+// their token version goes up, logging out the sessions that only had a
+// password. when it's already enabled, or there's no secret to enable,
+// it's sql.ErrNoRows
+func (m *PostgresDBRepo) EnableTOTP(userID int, step int64, recoveryCodeHashes []string) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `update users set totp_enabled_at = now(), totp_last_step = $1,
+				token_version = token_version + 1, updated_at = $2
+			where id = $3 and totp_enabled_at is null and totp_secret is not null`
+	result, err := tx.ExecContext(ctx, stmt, step, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+	if err := expectOneRow(result); err != nil {
+		return err
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ReplaceRecoveryCodes throws away the recovery codes of the user, used
+// or not, and stores the hashes of new ones
+func (m *PostgresDBRepo) ReplaceRecoveryCodes(userID int, recoveryCodeHashes []string) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int, recoveryCodeHashes []string) error {
+	_, err := tx.ExecContext(ctx, `delete from mfa_recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into mfa_recovery_codes (user_id, code_hash, created_at) values ($1, $2, $3)`
+	now := time.Now()
+	for _, hash := range recoveryCodeHashes {
+		if _, err := tx.ExecContext(ctx, stmt, userID, hash, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseTOTPStep records that the user logged in with the code for step.
+// a code for that step or an earlier one was used already when it's
+// sql.ErrNoRows
+func (m *PostgresDBRepo) UseTOTPStep(userID int, step int64) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set totp_last_step = $1
+			where id = $2 and totp_enabled_at is not null and totp_last_step < $1`
+	result, err := m.DB.ExecContext(ctx, stmt, step, userID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+// UseRecoveryCode uses up a recovery code of the user, one that's used or
+// isn't theirs is sql.ErrNoRows
+func (m *PostgresDBRepo) UseRecoveryCode(userID int, codeHash string) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	stmt := `update mfa_recovery_codes set used_at = now()
+			where user_id = $1 and code_hash = $2 and used_at is null`
+	result, err := m.DB.ExecContext(ctx, stmt, userID, codeHash)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+// CountRecoveryCodes is how many unused recovery codes the user has left
+func (m *PostgresDBRepo) CountRecoveryCodes(userID int) (int, error) {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	var count int
+	query := `select count(*) from mfa_recovery_codes where user_id = $1 and used_at is null`
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&count)
+	return count, err
+}
+
+// DisableTOTP turns off TOTP for the user and forgets their secret and
+// recovery codes. their token version goes up, logging them out everywhere
+func (m *PostgresDBRepo) DisableTOTP(userID int) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `update users set totp_secret = null, totp_enabled_at = null, totp_last_step = 0,
+				token_version = token_version + 1, updated_at = $1
+			where id = $2`
+	result, err := tx.ExecContext(ctx, stmt, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+	if err := expectOneRow(result); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from mfa_recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// isUniqueViolation tells whether err is Postgres refusing a duplicate in
+// the unique constraint or index named constraint
+func isUniqueViolation(err error, constraint string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == constraint
+}
+
+// UpdateUserProfile changes the name and email address of the user. a
+// new address isn't verified, and the verification links mailed for the
+// old one stop working. when another user has the address it's
+// repository.ErrDuplicateEmail
+func (m *PostgresDBRepo) UpdateUserProfile(user models.User) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldEmail string
+	err = tx.QueryRowContext(ctx, `select email from users where id = $1 for update`, user.ID).Scan(&oldEmail)
+	if err != nil {
+		return err
+	}
+
+	// on the right of the =, email is still the old address
+	stmt := `update users set first_name = $1, last_name = $2, email = $3,
+				email_verified_at = case when lower(email) = lower($3) then email_verified_at end,
+				updated_at = $4
+			where id = $5`
+	_, err = tx.ExecContext(ctx, stmt, user.FirstName, user.LastName, user.Email, time.Now(), user.ID)
+	if err != nil {
+		if isUniqueViolation(err, "users_email_key") {
+			return repository.ErrDuplicateEmail
+		}
+		return err
+	}
+
+	if !strings.EqualFold(oldEmail, user.Email) {
+		_, err = tx.ExecContext(ctx, `delete from email_verifications where user_id = $1`, user.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ChangePassword gives the user passwordHash as their password. their
+// token version goes up, which logs them out everywhere
+func (m *PostgresDBRepo) ChangePassword(userID int, passwordHash string) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set password = $1, token_version = token_version + 1,
+				password_change_required = false, updated_at = $2
+			where id = $3`
+	result, err := m.DB.ExecContext(ctx, stmt, passwordHash, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+	if err := expectOneRow(result); err != nil {
+		return err
+	}
+
+	// the links we mailed to reset it aren't needed any more
+	_, err = m.DB.ExecContext(ctx, `delete from password_resets where user_id = $1 and used_at is null`, userID)
+	return err
+}
+
+// DeleteUser deletes the user and everything that's theirs. the changes
+// they made to movies stay in the history, without their name on them.
+// the last admin can't be deleted, that's repository.ErrLastAdmin
+func (m *PostgresDBRepo) DeleteUser(userID int) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.keepAnAdmin(ctx, tx, userID); err != nil {
+		return err
+	}
+
+	// the idempotency keys aren't tied to users by a foreign key, the
+	// rest goes with the user (or loses its user_id, for the history)
+	_, err = tx.ExecContext(ctx, `delete from idempotency_keys where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `delete from users where id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	if err := expectOneRow(result); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// keepAnAdmin makes sure there's an (enabled) admin left once the user
+// with userID isn't one any more, repository.ErrLastAdmin when there wouldn't be. it
+// locks the admins until tx is done, so two admins can't both go at once
+func (m *PostgresDBRepo) keepAnAdmin(ctx context.Context, tx *sql.Tx, userID int) error {
+	// a disabled admin can't do anything as one
+	rows, err := tx.QueryContext(ctx, `select id from users where role = 'admin' and disabled_at is null for update`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	isAdmin, others := false, 0
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		if id == userID {
+			isAdmin = true
+		} else {
+			others++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if isAdmin && others == 0 {
+		return repository.ErrLastAdmin
+	}
+	return nil
+}
+
+// ListUsers returns one page of users, in the order they signed up
+func (m *PostgresDBRepo) ListUsers(page models.UserPageRequest) (*models.UserPage, error) {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if q := page.Filter.Query; q != "" {
+		// % and _ in what they typed are just characters
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q) + "%"
+		p := arg(pattern)
+		where = append(where, fmt.Sprintf("(email ilike %s or first_name ilike %s or last_name ilike %s or first_name || ' ' || last_name ilike %s)", p, p, p, p))
+	}
+	if page.Filter.Role != "" {
+		where = append(where, "role = "+arg(page.Filter.Role))
+	}
+	if page.Filter.Disabled != nil {
+		if *page.Filter.Disabled {
+			where = append(where, "disabled_at is not null")
+		} else {
+			where = append(where, "disabled_at is null")
+		}
+	}
+	if page.After > 0 {
+		where = append(where, "id > "+arg(page.After))
+	}
+
+	whereClause := ""
+	if len(where) > 0 {
+		whereClause = "where " + strings.Join(where, " and ")
+	}
+
+	// one more row than we need, if we get it there's another page
+	query := fmt.Sprintf(`
+		select
+			id, email, first_name, last_name, created_at, updated_at,
+			email_verified_at, role, disabled_at, password_change_required
+		from
+			users %s
+		order by
+			id
+		limit %s
+	`, whereClause, arg(page.First+1))
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := &models.UserPage{}
+	for rows.Next() {
+		var user models.User
+		var verifiedAt, disabledAt sql.NullTime
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&verifiedAt,
+			&user.Role,
+			&disabledAt,
+			&user.PasswordChangeRequired,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if verifiedAt.Valid {
+			user.EmailVerifiedAt = &verifiedAt.Time
+		}
+		if disabledAt.Valid {
+			user.DisabledAt = &disabledAt.Time
+		}
+		result.Users = append(result.Users, &user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(result.Users) > page.First {
+		result.Users = result.Users[:page.First]
+		result.HasNextPage = true
+	}
+	return result, nil
+}
+
+// CreateUser adds a user with the hash of a temporary password they're
+// asked to change, and returns their id. when somebody has the email
+// address already it's repository.ErrDuplicateEmail
+func (m *PostgresDBRepo) CreateUser(user models.User) (int, error) {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into users (first_name, last_name, email, password, role,
+				password_change_required, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, true, $6, $7)
+			returning id`
+	var id int
+	err := m.DB.QueryRowContext(ctx, stmt, user.FirstName, user.LastName, user.Email,
+		user.Password, user.Role, user.CreatedAt, user.UpdatedAt).Scan(&id)
+	if err != nil {
+		if isUniqueViolation(err, "users_email_key") {
+			return 0, repository.ErrDuplicateEmail
+		}
+		return 0, err
+	}
+	return id, nil
+}
+
+// SetUserDisabled disables or enables the account of the user. disabling
+// logs them out everywhere. the last admin can't be disabled, that's
+// repository.ErrLastAdmin
+func (m *PostgresDBRepo) SetUserDisabled(userID int, disabled bool) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `update users set disabled_at = null, updated_at = $1 where id = $2`
+	if disabled {
+		if err := m.keepAnAdmin(ctx, tx, userID); err != nil {
+			return err
+		}
+		// disabling twice keeps the time of the first
+		stmt = `update users set disabled_at = coalesce(disabled_at, now()),
+					token_version = token_version + 1, updated_at = $1
+				where id = $2`
+	}
+	result, err := tx.ExecContext(ctx, stmt, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+	if err := expectOneRow(result); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetUserRole gives the user role, and logs them out everywhere so their
+// tokens don't carry the old one. the last admin can't stop being one,
+// that's repository.ErrLastAdmin
+func (m *PostgresDBRepo) SetUserRole(userID int, role string) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if role != "admin" {
+		if err := m.keepAnAdmin(ctx, tx, userID); err != nil {
+			return err
+		}
+	}
+
+	stmt := `update users set role = $1, token_version = token_version + 1, updated_at = $2
+			where id = $3 and role <> $1`
+	if _, err := tx.ExecContext(ctx, stmt, role, time.Now(), userID); err != nil {
+		return err
+	}
+
+	// giving somebody the role they have already isn't an error, only a
+	// user that isn't there is
+	var exists bool
+	err = tx.QueryRowContext(ctx, `select exists(select 1 from users where id = $1)`, userID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return sql.ErrNoRows
+	}
+
+	return tx.Commit()
+}
+
+// RevokeSessions logs the user out everywhere: their token version goes
+// up, so none of their refresh tokens work any more
+func (m *PostgresDBRepo) RevokeSessions(userID int) error {
+	ctx, cancel := context.WithTimeout(m.baseContext(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set token_version = token_version + 1, updated_at = $1 where id = $2`
+	result, err := m.DB.ExecContext(ctx, stmt, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
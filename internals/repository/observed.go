@@ -0,0 +1,433 @@
+package repository
+
+import (
+	"backend/internals/models"
+	"context"
+	"database/sql"
+	"time"
+)
+
+// ObservedRepo wraps another DatabaseRepo and tells Observe about every
+// call: Observe is called with the method name before the call and gives
+// back the context to make it with and a function that's told how the
+// call went. that's how every query gets timed for our metrics and a
+// span of its own without touching the queries themselves
+type ObservedRepo struct {
+	Repo    DatabaseRepo
+	Observe func(ctx context.Context, method string) (context.Context, func(err error))
+
+	// the context of the request we're bound to, if any
+	ctx context.Context
+}
+
+var _ DatabaseRepo = (*ObservedRepo)(nil)
+
+// start tells Observe about a call and hands back the repository to make
+// it with. it's bound to the context Observe returned, so a span started
+// there is the parent of whatever the query does
+func (o *ObservedRepo) start(method string) (DatabaseRepo, func(err error)) {
+	if o.Observe == nil {
+		return o.Repo, func(error) {}
+	}
+	ctx := o.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, done := o.Observe(ctx, method)
+	return o.Repo.WithContext(ctx), done
+}
+
+// WithContext keeps observing the repository bound to ctx
+func (o *ObservedRepo) WithContext(ctx context.Context) DatabaseRepo {
+	return &ObservedRepo{Repo: o.Repo.WithContext(ctx), Observe: o.Observe, ctx: ctx}
+}
+
+// Connection isn't a query, there's nothing to observe
+func (o *ObservedRepo) Connection() *sql.DB {
+	return o.Repo.Connection()
+}
+
+func (o *ObservedRepo) Ping() error {
+	repo, done := o.start("Ping")
+	err := repo.Ping()
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) SchemaVersion() (int, bool, error) {
+	repo, done := o.start("SchemaVersion")
+	r1, r2, err := repo.SchemaVersion()
+	done(err)
+	return r1, r2, err
+}
+
+func (o *ObservedRepo) AllMovie(genre ...int) ([]*models.Movie, error) {
+	repo, done := o.start("AllMovie")
+	result, err := repo.AllMovie(genre...)
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) MoviesLastModified() (time.Time, error) {
+	repo, done := o.start("MoviesLastModified")
+	result, err := repo.MoviesLastModified()
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) MoviesPage(page models.MoviePageRequest) (*models.MoviePage, error) {
+	repo, done := o.start("MoviesPage")
+	result, err := repo.MoviesPage(page)
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) ExportMovies(filter models.MovieFilter, fn func(movie *models.Movie) error) error {
+	repo, done := o.start("ExportMovies")
+	err := repo.ExportMovies(filter, fn)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) GetUserByEmail(email string) (*models.User, error) {
+	repo, done := o.start("GetUserByEmail")
+	result, err := repo.GetUserByEmail(email)
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) GetUserByID(id int) (*models.User, error) {
+	repo, done := o.start("GetUserByID")
+	result, err := repo.GetUserByID(id)
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) OneMovie(id int) (*models.Movie, error) {
+	repo, done := o.start("OneMovie")
+	result, err := repo.OneMovie(id)
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) OneMovieForEdit(id int) (*models.Movie, []*models.Genre, error) {
+	repo, done := o.start("OneMovieForEdit")
+	r1, r2, err := repo.OneMovieForEdit(id)
+	done(err)
+	return r1, r2, err
+}
+
+func (o *ObservedRepo) AllGenres() ([]*models.Genre, error) {
+	repo, done := o.start("AllGenres")
+	result, err := repo.AllGenres()
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) InsertMovie(movie models.Movie) (int, error) {
+	repo, done := o.start("InsertMovie")
+	result, err := repo.InsertMovie(movie)
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) UpdateMovieGenre(id int, genresIDs []int) error {
+	repo, done := o.start("UpdateMovieGenre")
+	err := repo.UpdateMovieGenre(id, genresIDs)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) UpdateMovie(movie models.Movie, version time.Time) error {
+	repo, done := o.start("UpdateMovie")
+	err := repo.UpdateMovie(movie, version)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) DeleteMovie(id int, version time.Time) error {
+	repo, done := o.start("DeleteMovie")
+	err := repo.DeleteMovie(id, version)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) RestoreMovie(movie models.Movie) error {
+	repo, done := o.start("RestoreMovie")
+	err := repo.RestoreMovie(movie)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) ImportMovies(rows []models.MovieImportRow, commit, atomic bool) ([]models.ImportResult, bool, error) {
+	repo, done := o.start("ImportMovies")
+	r1, r2, err := repo.ImportMovies(rows, commit, atomic)
+	done(err)
+	return r1, r2, err
+}
+
+func (o *ObservedRepo) TrashedMovies() ([]*models.Movie, error) {
+	repo, done := o.start("TrashedMovies")
+	result, err := repo.TrashedMovies()
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) RestoreFromTrash(id int) error {
+	repo, done := o.start("RestoreFromTrash")
+	err := repo.RestoreFromTrash(id)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) PurgeMovie(id int) error {
+	repo, done := o.start("PurgeMovie")
+	err := repo.PurgeMovie(id)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) PurgeTrash(deletedBefore time.Time) ([]int, error) {
+	repo, done := o.start("PurgeTrash")
+	result, err := repo.PurgeTrash(deletedBefore)
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) InsertAuditEntry(entry models.AuditEntry) error {
+	repo, done := o.start("InsertAuditEntry")
+	err := repo.InsertAuditEntry(entry)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) ReserveIdempotencyKey(key string, userID int, requestHash string) (*models.IdempotencyRecord, bool, error) {
+	repo, done := o.start("ReserveIdempotencyKey")
+	r1, r2, err := repo.ReserveIdempotencyKey(key, userID, requestHash)
+	done(err)
+	return r1, r2, err
+}
+
+func (o *ObservedRepo) CompleteIdempotencyKey(record models.IdempotencyRecord) error {
+	repo, done := o.start("CompleteIdempotencyKey")
+	err := repo.CompleteIdempotencyKey(record)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) ReleaseIdempotencyKey(key string, userID int) error {
+	repo, done := o.start("ReleaseIdempotencyKey")
+	err := repo.ReleaseIdempotencyKey(key, userID)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) DeleteIdempotencyKeys(createdBefore time.Time) (int64, error) {
+	repo, done := o.start("DeleteIdempotencyKeys")
+	result, err := repo.DeleteIdempotencyKeys(createdBefore)
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) MovieHistory(movieID int) ([]*models.AuditEntry, error) {
+	repo, done := o.start("MovieHistory")
+	result, err := repo.MovieHistory(movieID)
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) GetAuditEntry(id int) (*models.AuditEntry, error) {
+	repo, done := o.start("GetAuditEntry")
+	result, err := repo.GetAuditEntry(id)
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) UpdateRateLimitBucket(key string, update func(bucket *models.RateLimitBucket) error) error {
+	repo, done := o.start("UpdateRateLimitBucket")
+	err := repo.UpdateRateLimitBucket(key, update)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) GetLoginFailures(key string) (*models.LoginFailures, error) {
+	repo, done := o.start("GetLoginFailures")
+	result, err := repo.GetLoginFailures(key)
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) UpdateLoginFailures(key string, update func(failures *models.LoginFailures) error) error {
+	repo, done := o.start("UpdateLoginFailures")
+	err := repo.UpdateLoginFailures(key, update)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) DeleteLoginFailures(key string) error {
+	repo, done := o.start("DeleteLoginFailures")
+	err := repo.DeleteLoginFailures(key)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) PurgeRateLimits(bucketsBefore, failuresBefore time.Time) error {
+	repo, done := o.start("PurgeRateLimits")
+	err := repo.PurgeRateLimits(bucketsBefore, failuresBefore)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) CreatePasswordReset(reset models.PasswordReset) error {
+	repo, done := o.start("CreatePasswordReset")
+	err := repo.CreatePasswordReset(reset)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) GetPasswordReset(tokenHash string) (*models.PasswordReset, error) {
+	repo, done := o.start("GetPasswordReset")
+	result, err := repo.GetPasswordReset(tokenHash)
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) ResetPassword(tokenHash, passwordHash string) (int, error) {
+	repo, done := o.start("ResetPassword")
+	result, err := repo.ResetPassword(tokenHash, passwordHash)
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) DeletePasswordResets(expiredBefore time.Time) (int64, error) {
+	repo, done := o.start("DeletePasswordResets")
+	result, err := repo.DeletePasswordResets(expiredBefore)
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) CreateEmailVerification(verification models.EmailVerification) error {
+	repo, done := o.start("CreateEmailVerification")
+	err := repo.CreateEmailVerification(verification)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) VerifyEmail(tokenHash string) (int, error) {
+	repo, done := o.start("VerifyEmail")
+	result, err := repo.VerifyEmail(tokenHash)
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) DeleteEmailVerifications(expiredBefore time.Time) (int64, error) {
+	repo, done := o.start("DeleteEmailVerifications")
+	result, err := repo.DeleteEmailVerifications(expiredBefore)
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) SetPendingTOTP(userID int, secret string) error {
+	repo, done := o.start("SetPendingTOTP")
+	err := repo.SetPendingTOTP(userID, secret)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) EnableTOTP(userID int, step int64, recoveryCodeHashes []string) error {
+	repo, done := o.start("EnableTOTP")
+	err := repo.EnableTOTP(userID, step, recoveryCodeHashes)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) ReplaceRecoveryCodes(userID int, recoveryCodeHashes []string) error {
+	repo, done := o.start("ReplaceRecoveryCodes")
+	err := repo.ReplaceRecoveryCodes(userID, recoveryCodeHashes)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) UseTOTPStep(userID int, step int64) error {
+	repo, done := o.start("UseTOTPStep")
+	err := repo.UseTOTPStep(userID, step)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) UseRecoveryCode(userID int, codeHash string) error {
+	repo, done := o.start("UseRecoveryCode")
+	err := repo.UseRecoveryCode(userID, codeHash)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) CountRecoveryCodes(userID int) (int, error) {
+	repo, done := o.start("CountRecoveryCodes")
+	result, err := repo.CountRecoveryCodes(userID)
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) DisableTOTP(userID int) error {
+	repo, done := o.start("DisableTOTP")
+	err := repo.DisableTOTP(userID)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) UpdateUserProfile(user models.User) error {
+	repo, done := o.start("UpdateUserProfile")
+	err := repo.UpdateUserProfile(user)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) ChangePassword(userID int, passwordHash string) error {
+	repo, done := o.start("ChangePassword")
+	err := repo.ChangePassword(userID, passwordHash)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) DeleteUser(userID int) error {
+	repo, done := o.start("DeleteUser")
+	err := repo.DeleteUser(userID)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) ListUsers(page models.UserPageRequest) (*models.UserPage, error) {
+	repo, done := o.start("ListUsers")
+	result, err := repo.ListUsers(page)
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) CreateUser(user models.User) (int, error) {
+	repo, done := o.start("CreateUser")
+	result, err := repo.CreateUser(user)
+	done(err)
+	return result, err
+}
+
+func (o *ObservedRepo) SetUserDisabled(userID int, disabled bool) error {
+	repo, done := o.start("SetUserDisabled")
+	err := repo.SetUserDisabled(userID, disabled)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) SetUserRole(userID int, role string) error {
+	repo, done := o.start("SetUserRole")
+	err := repo.SetUserRole(userID, role)
+	done(err)
+	return err
+}
+
+func (o *ObservedRepo) RevokeSessions(userID int) error {
+	repo, done := o.start("RevokeSessions")
+	err := repo.RevokeSessions(userID)
+	done(err)
+	return err
+}
@@ -2,13 +2,35 @@ package repository
 
 import (
 	"backend/internals/models"
+	"context"
 	"database/sql"
+	"errors"
+	"time"
 )
 
+// errors the repository gives back that mean something to the client,
+// they're answered differently from the database just failing
+var (
+	ErrDuplicateEmail = errors.New("the email address belongs to another account")
+	ErrLastAdmin      = errors.New("there has to be at least one admin")
+	ErrMovieChanged   = errors.New("the movie has been changed by someone else, reload it and try again")
+)
+
+// ImportTimeout is how long ImportMovies has. a bulk import can be
+// thousands of rows, it gets a lot more time than a single query does
+const ImportTimeout = 2 * time.Minute
+
 // pretty much everthing in go is an interface
 type DatabaseRepo interface {
 	Connection() *sql.DB
+	// WithContext binds the repository to the context of a request
+	WithContext(ctx context.Context) DatabaseRepo
+	Ping() error
+	SchemaVersion() (int, bool, error)
 	AllMovie(genre ...int) ([]*models.Movie, error)
+	MoviesLastModified() (time.Time, error)
+	MoviesPage(page models.MoviePageRequest) (*models.MoviePage, error)
+	ExportMovies(filter models.MovieFilter, fn func(movie *models.Movie) error) error
 	GetUserByEmail(email string) (*models.User, error)
 	GetUserByID(id int) (*models.User, error)
 	OneMovie(id int) (*models.Movie, error)
@@ -16,6 +38,46 @@ type DatabaseRepo interface {
 	AllGenres() ([]*models.Genre, error)
 	InsertMovie(movie models.Movie) (int, error)
 	UpdateMovieGenre(id int, genresIDs []int) error
-	UpdateMovie(movie models.Movie) error
-	DeleteMovie(id int) error
+	UpdateMovie(movie models.Movie, version time.Time) error
+	DeleteMovie(id int, version time.Time) error
+	RestoreMovie(movie models.Movie) error
+	ImportMovies(rows []models.MovieImportRow, commit, atomic bool) ([]models.ImportResult, bool, error)
+	TrashedMovies() ([]*models.Movie, error)
+	RestoreFromTrash(id int) error
+	PurgeMovie(id int) error
+	PurgeTrash(deletedBefore time.Time) ([]int, error)
+	InsertAuditEntry(entry models.AuditEntry) error
+	ReserveIdempotencyKey(key string, userID int, requestHash string) (*models.IdempotencyRecord, bool, error)
+	CompleteIdempotencyKey(record models.IdempotencyRecord) error
+	ReleaseIdempotencyKey(key string, userID int) error
+	DeleteIdempotencyKeys(createdBefore time.Time) (int64, error)
+	MovieHistory(movieID int) ([]*models.AuditEntry, error)
+	GetAuditEntry(id int) (*models.AuditEntry, error)
+	UpdateRateLimitBucket(key string, update func(bucket *models.RateLimitBucket) error) error
+	GetLoginFailures(key string) (*models.LoginFailures, error)
+	UpdateLoginFailures(key string, update func(failures *models.LoginFailures) error) error
+	DeleteLoginFailures(key string) error
+	PurgeRateLimits(bucketsBefore, failuresBefore time.Time) error
+	CreatePasswordReset(reset models.PasswordReset) error
+	GetPasswordReset(tokenHash string) (*models.PasswordReset, error)
+	ResetPassword(tokenHash, passwordHash string) (int, error)
+	DeletePasswordResets(expiredBefore time.Time) (int64, error)
+	CreateEmailVerification(verification models.EmailVerification) error
+	VerifyEmail(tokenHash string) (int, error)
+	DeleteEmailVerifications(expiredBefore time.Time) (int64, error)
+	SetPendingTOTP(userID int, secret string) error
+	EnableTOTP(userID int, step int64, recoveryCodeHashes []string) error
+	ReplaceRecoveryCodes(userID int, recoveryCodeHashes []string) error
+	UseTOTPStep(userID int, step int64) error
+	UseRecoveryCode(userID int, codeHash string) error
+	CountRecoveryCodes(userID int) (int, error)
+	DisableTOTP(userID int) error
+	UpdateUserProfile(user models.User) error
+	ChangePassword(userID int, passwordHash string) error
+	DeleteUser(userID int) error
+	ListUsers(page models.UserPageRequest) (*models.UserPage, error)
+	CreateUser(user models.User) (int, error)
+	SetUserDisabled(userID int, disabled bool) error
+	SetUserRole(userID int, role string) error
+	RevokeSessions(userID int) error
 }
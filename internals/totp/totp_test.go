@@ -0,0 +1,79 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// the secret of the test vectors in RFC 6238 appendix B, "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeRFC6238(t *testing.T) {
+	// the SHA-1 vectors, cut down from 8 digits to the last 6
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		code, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("at %d: got %s, want %s", tt.unix, code, tt.code)
+		}
+	}
+}
+
+func TestCodeLowerCaseSecret(t *testing.T) {
+	lower, err := Code("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upper, _ := Code(rfcSecret, 1)
+	if lower != upper {
+		t.Errorf("got %s for the lower case secret, %s for the upper case one", lower, upper)
+	}
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("a secret that isn't base32 gave a code")
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+
+	for offset := int64(-3); offset <= 3; offset++ {
+		code, _ := Code(rfcSecret, current+offset)
+		step, ok := Validate(rfcSecret, code, now, 1)
+
+		inside := offset >= -1 && offset <= 1
+		if ok != inside {
+			t.Errorf("code %d steps off: accepted %v, want %v", offset, ok, inside)
+		}
+		// the step is what UseTOTPStep records, so the same code can't
+		// be used twice
+		if ok && step != current+offset {
+			t.Errorf("code %d steps off: got step %d, want %d", offset, step, current+offset)
+		}
+	}
+}
+
+func TestValidateFormat(t *testing.T) {
+	now := time.Unix(59, 0)
+	if _, ok := Validate(rfcSecret, " 287 082 ", now, 0); !ok {
+		t.Error("a code with spaces in it was refused")
+	}
+	for _, code := range []string{"", "28708", "2870820", "94287082"} {
+		if _, ok := Validate(rfcSecret, code, now, 1); ok {
+			t.Errorf("%q was accepted", code)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Package tracing has what we need for OpenTelemetry that the SDK doesn't
+// come with
+package tracing
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// FileClient is an OTLP client that, instead of sending spans to a
+// collector, appends them to a file: one OTLP/JSON export request per
+// line. that's the format the collector's file exporter writes (and its
+// otlpjsonfile receiver reads), so a trace written locally can be looked
+// at with jq or loaded into a real backend later
+type FileClient struct {
+	Path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// Start opens the file, we keep what's in there already
+func (c *FileClient) Start(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, err := os.OpenFile(c.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	c.file = f
+	return nil
+}
+
+// Stop closes the file. it's only called once everything is exported
+func (c *FileClient) Stop(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+// UploadTraces writes a batch of spans as one line
+func (c *FileClient) UploadTraces(ctx context.Context, spans []*tracepb.ResourceSpans) error {
+	line, err := protojson.Marshal(&coltracepb.ExportTraceServiceRequest{ResourceSpans: spans})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil {
+		return os.ErrClosed
+	}
+	_, err = c.file.Write(append(line, '\n'))
+	return err
+}